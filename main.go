@@ -4,21 +4,35 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/briandowns/spinner"
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 	"github.com/sashabaranov/go-openai"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -26,6 +40,8 @@ import (
 
 const Version = "1.0.4"
 
+const repoContextFile = ".gai-context.md"
+
 //go:embed templates/systemInstructions.md
 var embeddedSystemInstructions string
 
@@ -38,6 +54,15 @@ var embeddedPRBodyFormattingInstructions string
 //go:embed templates/commitFormattingInstructions.md
 var embeddedCommitFormattingInstructions string
 
+//go:embed templates/releaseNotesFormattingInstructions.md
+var embeddedReleaseNotesFormattingInstructions string
+
+//go:embed templates/prReviewInstructions.md
+var embeddedPRReviewInstructions string
+
+//go:embed templates/gitignoreInstructions.md
+var embeddedGitignoreInstructions string
+
 //go:embed templates/asciiHeader.txt
 var ASCIIHeader string
 
@@ -59,22 +84,76 @@ type GitAIException struct{ msg string }
 
 func (e GitAIException) Error() string { return e.msg }
 
-type GitOperations struct{}
+type GitOperations struct {
+	// Pathspec limits the diffs and the commit to these paths when set.
+	Pathspec []string
+	// DiffBase is the revision staged changes are compared to instead of HEAD,
+	// e.g. the parent of a commit being amended.
+	DiffBase string
+}
+
+// diffArgs builds the git diff arguments for the staged or unstaged changes.
+func (g *GitOperations) diffArgs(staged bool, flags ...string) []string {
+	args := append([]string{"diff"}, flags...)
+	if staged {
+		args = append(args, "--cached")
+		if g.DiffBase != "" {
+			args = append(args, g.DiffBase)
+		}
+	}
+	return g.withPathspec(args)
+}
+
+// withPathspec appends the Pathspec to the git arguments.
+func (g *GitOperations) withPathspec(args []string) []string {
+	if len(g.Pathspec) == 0 {
+		return args
+	}
+	return append(append(args, "--"), g.Pathspec...)
+}
 
 func (g *GitOperations) GetDiff(staged bool) (string, error) {
 	logDebug(fmt.Sprintf("Fetching %s diff (git diff %s)",
 		map[bool]string{true: "staged", false: "unstaged"}[staged],
 		map[bool]string{true: "--cached", false: ""}[staged]))
-	args := []string{"diff"}
-	if staged {
-		args = append(args, "--cached")
+	return runCmd("git", g.diffArgs(staged)...)
+}
+
+func (g *GitOperations) GetDiffStat(staged bool) (string, error) {
+	return runCmd("git", g.diffArgs(staged, "--stat")...)
+}
+
+func (g *GitOperations) GetNumStat(staged bool) (string, error) {
+	return runCmd("git", g.diffArgs(staged, "--numstat")...)
+}
+
+func (g *GitOperations) GetNameStatus(staged bool) (string, error) {
+	return runCmd("git", g.diffArgs(staged, "--name-status")...)
+}
+
+func (g *GitOperations) GetChangedFiles(staged bool) ([]string, error) {
+	out, err := runCmd("git", g.diffArgs(staged, "--name-only")...)
+	if err != nil || out == "" {
+		return nil, err
 	}
-	return runCmd("git", args...)
+	return strings.Split(out, "\n"), nil
 }
 
 func (g *GitOperations) StageAllChanges() error {
-	logDebug("Staging all changes (git add .)")
-	_, err := runCmd("git", "add", ".")
+	args := []string{"add", "--", "."}
+	for _, pattern := range splitList(viper.GetString("AUTO_STAGE_EXCLUDE")) {
+		args = append(args, ":(exclude)"+pattern)
+	}
+	logDebug(fmt.Sprintf("Staging all changes (git %s)", strings.Join(args, " ")))
+	_, err := runCmd("git", args...)
+	return err
+}
+
+// StagePaths stages the changes of the given pathspec.
+func (g *GitOperations) StagePaths(pathspec []string) error {
+	args := append([]string{"add", "--"}, pathspec...)
+	logDebug(fmt.Sprintf("Staging paths (git %s)", strings.Join(args, " ")))
+	_, err := runCmd("git", args...)
 	return err
 }
 
@@ -83,12 +162,132 @@ func (g *GitOperations) GetCurrentBranch() (string, error) {
 	return runCmd("git", "rev-parse", "--abbrev-ref", "HEAD")
 }
 
+func (g *GitOperations) GetRepoRoot() (string, error) {
+	logDebug("Getting repository root (git rev-parse --show-toplevel)")
+	return runCmd("git", "rev-parse", "--show-toplevel")
+}
+
+// HasCommits reports whether HEAD points to a commit, which is false in a
+// freshly initialized repository.
+func (g *GitOperations) HasCommits() bool {
+	_, err := runCmd("git", "rev-parse", "--verify", "--quiet", "HEAD")
+	return err == nil
+}
+
+func (g *GitOperations) RefExists(ref string) bool {
+	_, err := runCmd("git", "rev-parse", "--verify", "--quiet", ref)
+	return err == nil
+}
+
+// commitRange returns the revision range of the branch commits, covering the
+// whole branch when origin has no main branch yet.
+func (g *GitOperations) commitRange(mainBranch, currentBranch string) string {
+	base := fmt.Sprintf("origin/%s", mainBranch)
+	if !g.RefExists(base) {
+		logDebug(fmt.Sprintf("%s does not exist. Using all commits of %s", base, currentBranch))
+		return currentBranch
+	}
+	return fmt.Sprintf("%s..%s", base, currentBranch)
+}
+
 func (g *GitOperations) GetCommitMessages(mBranch, currentBranch string) (string, error) {
 	logDebug(fmt.Sprintf("Getting commit messages between origin/%s..%s", mBranch, currentBranch))
-	return runCmd("git", "log",
-		fmt.Sprintf("origin/%s..%s", mBranch, currentBranch),
-		"--pretty=format:%s",
-		"--no-merges")
+	args := append([]string{"log", g.commitRange(mBranch, currentBranch), "--pretty=format:%s"}, noMergesArgs()...)
+	out, err := runCmd("git", args...)
+	if err != nil || !viper.GetBool("PR_FILTER_FIXUP") {
+		return out, err
+	}
+	return filterFixupCommits(out), nil
+}
+
+// noMergesArgs returns the --no-merges flag for commit listings unless
+// NO_MERGES is disabled.
+func noMergesArgs() []string {
+	if !viper.GetBool("NO_MERGES") {
+		return nil
+	}
+	return []string{"--no-merges"}
+}
+
+// IsPushed reports whether HEAD matches its upstream branch, e.g. when a
+// previous push succeeded but the pull request step failed.
+func (g *GitOperations) IsPushed() bool {
+	upstream, err := runCmd("git", "rev-parse", "--verify", "--quiet", "@{u}")
+	if err != nil {
+		return false
+	}
+	head, err := runCmd("git", "rev-parse", "HEAD")
+	return err == nil && head == upstream
+}
+
+// AheadBehind counts the commits of branch missing from base (ahead) and of
+// base missing from branch (behind).
+func (g *GitOperations) AheadBehind(base, branch string) (ahead, behind int, err error) {
+	out, err := runCmd("git", "rev-list", "--left-right", "--count", fmt.Sprintf("%s...%s", branch, base))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to compare %s with %s: %w", branch, base, err)
+	}
+	if _, err := fmt.Sscanf(out, "%d %d", &ahead, &behind); err != nil {
+		return 0, 0, fmt.Errorf("unexpected rev-list output %q", out)
+	}
+	return ahead, behind, nil
+}
+
+// CountMerges counts the merge commits in the revision range.
+func (g *GitOperations) CountMerges(revRange string) (int, error) {
+	out, err := runCmd("git", "rev-list", "--count", "--merges", revRange)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(out)
+}
+
+// filterFixupCommits drops the fixup!/squash! subjects that will disappear
+// once the branch is autosquashed.
+func filterFixupCommits(subjects string) string {
+	var kept []string
+	for _, subject := range strings.Split(subjects, "\n") {
+		if strings.HasPrefix(subject, "fixup!") || strings.HasPrefix(subject, "squash!") {
+			logDebug(fmt.Sprintf("Skipping autosquash commit: %s", subject))
+			continue
+		}
+		kept = append(kept, subject)
+	}
+	return strings.Join(kept, "\n")
+}
+
+func (g *GitOperations) GetCommitMessage(ref string) (string, error) {
+	logDebug(fmt.Sprintf("Getting commit message of %s (git log -1 --pretty=format:%%B %s)", ref, ref))
+	return runCmd("git", "log", "-1", "--pretty=format:%B", ref)
+}
+
+// PushedTo returns the first remote branch that contains the commit, or an
+// empty string when it is not pushed anywhere.
+func (g *GitOperations) PushedTo(sha string) string {
+	remotes, _ := runCmd("git", "branch", "-r", "--contains", sha)
+	if fields := strings.Fields(remotes); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+func (g *GitOperations) GetLastTag() (string, error) {
+	logDebug("Getting last tag (git describe --tags --abbrev=0)")
+	return runCmd("git", "describe", "--tags", "--abbrev=0")
+}
+
+func (g *GitOperations) GetTagDate(tag string) (string, error) {
+	logDebug(fmt.Sprintf("Getting date of tag %s", tag))
+	return runCmd("git", "log", "-1", "--pretty=format:%cs", tag)
+}
+
+func (g *GitOperations) GetCommitsSince(ref string) (string, error) {
+	logDebug(fmt.Sprintf("Getting commit messages since %s", ref))
+	args := append([]string{"log", "--pretty=format:%s"}, noMergesArgs()...)
+	if ref != "" {
+		args = append(args, ref+"..HEAD")
+	}
+	return runCmd("git", args...)
 }
 
 func (g *GitOperations) Fetch(remote, branch string) error {
@@ -102,6 +301,21 @@ func (g *GitOperations) Fetch(remote, branch string) error {
 	return nil
 }
 
+// RemoteBranchExists reports whether the branch exists on the remote.
+func (g *GitOperations) RemoteBranchExists(remote, branch string) bool {
+	out, err := runCmd("git", "ls-remote", "--heads", remote, branch)
+	return err != nil || out != ""
+}
+
+// RemoteURL returns the URL of the remote.
+func (g *GitOperations) RemoteURL(remote string) (string, error) {
+	out, err := runCmd("git", "remote", "get-url", remote)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s URL: %w", remote, err)
+	}
+	return out, nil
+}
+
 func (g *GitOperations) Push(currentBranch, remote string, flags []string) error {
 	pushArgs := append([]string{"push", remote, currentBranch}, flags...)
 	logDebug(fmt.Sprintf("Executing command: git %s", strings.Join(pushArgs, " ")))
@@ -114,9 +328,87 @@ func (g *GitOperations) Push(currentBranch, remote string, flags []string) error
 	return nil
 }
 
-func (g *GitOperations) Commit(commitMessage string, flags []string) error {
+// containsFlag reports whether flags contain flag, also with an attached
+// value such as --gpg-sign=KEY or -SKEY.
+func containsFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag || strings.HasPrefix(f, flag+"=") || (len(flag) == 2 && flag[0] == '-' && strings.HasPrefix(f, flag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyCommit checks the signature of the commit and reports the result,
+// returning git's verification output on failure.
+func (g *GitOperations) VerifyCommit(ref string) error {
+	out, err := runCmd("git", "verify-commit", ref)
+	if err != nil {
+		return fmt.Errorf("failed to verify the signature of %s: %w\nOutput: %s", ref, err, out)
+	}
+	logMessage(color.FgGreen, "🔏 Commit signature verified.")
+	logDebug(out)
+	return nil
+}
+
+// CreateTag creates an annotated tag on HEAD with the message as its notes.
+func (g *GitOperations) CreateTag(tag, message string) error {
+	logDebug(fmt.Sprintf("Executing command: git tag -a %s", tag))
+	out, err := runCmd("git", "tag", "-a", tag, "-m", message)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to create tag %s: %v\nOutput: %s", tag, err, out))
+		return fmt.Errorf("failed to create tag %s: %w", tag, err)
+	}
+	logMessage(color.FgGreen, fmt.Sprintf("🔖 Tag %s created successfully!", tag))
+	return nil
+}
+
+func (g *GitOperations) PushTag(remote, tag string) error {
+	logDebug(fmt.Sprintf("Executing command: git push %s refs/tags/%s", remote, tag))
+	out, err := runCmd("git", "push", remote, "refs/tags/"+tag)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to push tag %s: %v\nOutput: %s", tag, err, out))
+		return fmt.Errorf("failed to push tag %s: %w", tag, err)
+	}
+	logMessage(color.FgBlue, fmt.Sprintf("🚀 Tag %s pushed successfully!", tag))
+	return nil
+}
+
+// buildCommitArgs returns the git commit arguments for the message. With
+// COMMIT_SEPARATE_BODY the subject and body are passed as separate -m values.
+func buildCommitArgs(commitMessage string, flags []string) []string {
 	commitArgs := append([]string{"commit"}, flags...)
-	commitArgs = append(commitArgs, "-m", commitMessage)
+	subject, body, _ := strings.Cut(commitMessage, "\n")
+	body = strings.TrimSpace(body)
+	if viper.GetBool("COMMIT_SEPARATE_BODY") && body != "" {
+		return append(commitArgs, "-m", strings.TrimSpace(subject), "-m", body)
+	}
+	return append(commitArgs, "-m", commitMessage)
+}
+
+var authorRe = regexp.MustCompile(`^[^<>]+ <[^<>\s]+@[^<>\s]+>$`)
+
+// withAuthor adds --author for the AUTHOR config unless the git flags already
+// set one, in which case the explicit flag wins.
+func withAuthor(flags []string) ([]string, error) {
+	author := strings.TrimSpace(viper.GetString("AUTHOR"))
+	if author == "" {
+		return flags, nil
+	}
+	for _, flag := range flags {
+		if flag == "--author" || strings.HasPrefix(flag, "--author=") {
+			logDebug("Ignoring AUTHOR, --author already passed to git commit")
+			return flags, nil
+		}
+	}
+	if !authorRe.MatchString(author) {
+		return nil, GitAIException{fmt.Sprintf("Invalid author %q, expected \"Name <email>\"", author)}
+	}
+	return append(flags, "--author="+author), nil
+}
+
+func (g *GitOperations) Commit(commitMessage string, flags []string) error {
+	commitArgs := g.withPathspec(buildCommitArgs(commitMessage, flags))
 	logDebug(fmt.Sprintf("Executing command: git %s", strings.Join(commitArgs, " ")))
 	out, err := runCmd("git", commitArgs...)
 	if err != nil {
@@ -127,6 +419,47 @@ func (g *GitOperations) Commit(commitMessage string, flags []string) error {
 	return nil
 }
 
+// AddTrailer appends a "Key: value" trailer to the message with git
+// interpret-trailers, skipping it when an identical one is already present.
+func (g *GitOperations) AddTrailer(message, trailer string) (string, error) {
+	logDebug(fmt.Sprintf("Adding trailer: %s", trailer))
+	cmd := exec.Command(binaryPath("git"), "interpret-trailers", "--if-exists", "addIfDifferent", "--trailer", trailer)
+	cmd.Stdin = strings.NewReader(strings.TrimSpace(message) + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git interpret-trailers failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ApplyCached applies the patch to the index only, leaving the working tree
+// untouched.
+func (g *GitOperations) ApplyCached(patch string) error {
+	logDebug("Applying patch to the index (git apply --cached)")
+	cmd := exec.Command(binaryPath("git"), "apply", "--cached", "-")
+	cmd.Stdin = strings.NewReader(patch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git apply --cached failed: %w\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// GetUntrackedFiles lists untracked paths, with untracked directories
+// collapsed the way git status shows them.
+func (g *GitOperations) GetUntrackedFiles() ([]string, error) {
+	out, err := runCmd("git", "status", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "?? ") {
+			files = append(files, strings.Trim(strings.TrimPrefix(line, "?? "), `"`))
+		}
+	}
+	return files, nil
+}
+
 func (g *GitOperations) HasChanges() (bool, error) {
 	stagedDiff, err := g.GetDiff(true)
 	if err != nil {
@@ -136,15 +469,25 @@ func (g *GitOperations) HasChanges() (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if !g.HasCommits() {
+		// Before the first commit every file is untracked and absent from git diff
+		status, err := runCmd("git", "status", "--porcelain")
+		if err != nil {
+			return false, err
+		}
+		return strings.TrimSpace(status) != "", nil
+	}
 	return strings.TrimSpace(stagedDiff) != "" || strings.TrimSpace(unstagedDiff) != "", nil
 }
 
 func (g *GitOperations) HasCommitsToPush(mainBranch, currentBranch string) (bool, error) {
-	commitMsgs, err := g.GetCommitMessages(mainBranch, currentBranch)
+	logDebug(fmt.Sprintf("Counting commits between origin/%s..%s", mainBranch, currentBranch))
+	args := append([]string{"rev-list", "--count"}, noMergesArgs()...)
+	out, err := runCmd("git", append(args, g.commitRange(mainBranch, currentBranch))...)
 	if err != nil {
 		return false, err
 	}
-	return strings.TrimSpace(commitMsgs) != "", nil
+	return strings.TrimSpace(out) != "0", nil
 }
 
 func streamOutput(cmd *exec.Cmd) (string, error) {
@@ -206,9 +549,25 @@ func streamOutput(cmd *exec.Cmd) (string, error) {
 	return strings.TrimSpace(combinedOutput.String()), err
 }
 
+// binaryPath returns the executable configured for git (GIT_BINARY) and gh
+// (GH_BINARY), or the name itself for any other command.
+func binaryPath(name string) string {
+	configured := ""
+	switch name {
+	case "git":
+		configured = viper.GetString("GIT_BINARY")
+	case "gh":
+		configured = viper.GetString("GH_BINARY")
+	}
+	if configured == "" {
+		return name
+	}
+	return configured
+}
+
 func runCmd(name string, args ...string) (string, error) {
 	logDebug(fmt.Sprintf("Running command: %s %v", name, args))
-	cmd := exec.Command(name, args...)
+	cmd := exec.Command(binaryPath(name), args...)
 
 	// Use real-time output for git operations
 	if name == "git" && len(args) > 0 {
@@ -225,9 +584,21 @@ func runCmd(name string, args ...string) (string, error) {
 
 func performWithSpinner(desc string, fn func() (string, error)) (string, error) {
 	s := spinner.New(spinner.CharSets[9], 100*time.Millisecond)
+	s.Writer = os.Stderr
 	s.Prefix = fmt.Sprintf("%s... ", desc)
 	s.Start()
 	defer s.Stop()
+	if slowAfter := viper.GetInt("SLOW_WARNING_SECONDS"); slowAfter > 0 {
+		timer := time.AfterFunc(time.Duration(slowAfter)*time.Second, func() {
+			s.Lock()
+			s.Prefix = fmt.Sprintf("%s (taking longer than usual, over %ds)... ", desc, slowAfter)
+			if timeout := aiTimeout(); timeout > 0 {
+				s.Prefix = fmt.Sprintf("%s (taking longer than usual, over %ds, times out after %gs)... ", desc, slowAfter, timeout.Seconds())
+			}
+			s.Unlock()
+		})
+		defer timer.Stop()
+	}
 	return fn()
 }
 
@@ -240,7 +611,75 @@ func executeCommandWithCheck(name string, args ...string) {
 	}
 }
 
+// normalizeDiff drops the parts of a diff the model does not need when
+// COMPACT_DIFF is set: index and mode lines, hunk headers and context lines.
+// File headers and the added/removed lines are kept.
+func normalizeDiff(diff string) string {
+	if !viper.GetBool("COMPACT_DIFF") {
+		return diff
+	}
+	var kept []string
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "),
+			strings.HasPrefix(line, "new file"),
+			strings.HasPrefix(line, "deleted file"),
+			strings.HasPrefix(line, "rename "),
+			strings.HasPrefix(line, "Binary files "):
+			kept = append(kept, line)
+		case strings.HasPrefix(line, "--- a/"), strings.HasPrefix(line, "+++ b/"),
+			line == "--- /dev/null", line == "+++ /dev/null":
+		case strings.HasPrefix(line, "+"), strings.HasPrefix(line, "-"):
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// isTestPath reports whether the path matches one of the comma-separated
+// TEST_PATTERNS. Patterns ending in "/" match a directory at any depth, the
+// others are globs matched against the full path and the file name.
+func isTestPath(path string) bool {
+	for _, pattern := range splitList(viper.GetString("TEST_PATTERNS")) {
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(path, pattern) || strings.Contains(path, "/"+pattern) {
+				return true
+			}
+			continue
+		}
+		fullMatch, _ := filepath.Match(pattern, path)
+		baseMatch, _ := filepath.Match(pattern, filepath.Base(path))
+		if fullMatch || baseMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeTestFiles drops the files matching TEST_PATTERNS from the diff. The
+// diff is returned unchanged when it only touches tests.
+func excludeTestFiles(diff string) string {
+	starts := diffFileRe.FindAllStringSubmatchIndex(diff, -1)
+	var kept strings.Builder
+	for i, m := range starts {
+		end := len(diff)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		if path := diff[m[2]:m[3]]; isTestPath(path) {
+			logDebug(fmt.Sprintf("Leaving test file %s out of the AI input", path))
+			continue
+		}
+		kept.WriteString(diff[m[0]:end])
+	}
+	if kept.Len() == 0 {
+		return diff
+	}
+	return kept.String()
+}
+
 func buildInputData(ticketNumber, branchName, prTitle, commits, diff string) string {
+	diff = normalizeDiff(diff)
 	return fmt.Sprintf(`INPUT:
 TICKET NUMBER: %s
 BRANCH NAME:   %s
@@ -252,342 +691,3943 @@ GIT DIFFERENCE TO HEAD:
 `, ticketNumber, branchName, prTitle, commits, diff)
 }
 
-type GitAI struct {
-	gitOps       *GitOperations
-	openAIClient *openai.Client
-}
-
-func (g *GitAI) GenerateMessage(systemInstructions, userInstructions, inputData string) (string, error) {
-	logDebug("Preparing OpenAI request")
-	var resp openai.ChatCompletionResponse
-	_, err := performWithSpinner("🤖 Generating AI message", func() (string, error) {
-		r, e := g.openAIClient.CreateChatCompletion(
-			context.Background(),
-			openai.ChatCompletionRequest{
-				Model:       viper.GetString("OPENAI_MODEL"),
-				MaxTokens:   viper.GetInt("OPENAI_MAX_TOKENS"),
-				Temperature: float32(viper.GetFloat64("OPENAI_TEMPERATURE")),
-				TopP:        float32(viper.GetFloat64("OPENAI_TOP_P")),
-				Messages: []openai.ChatCompletionMessage{
-					{Role: openai.ChatMessageRoleSystem, Content: systemInstructions},
-					{Role: openai.ChatMessageRoleUser, Content: userInstructions},
-					{Role: openai.ChatMessageRoleUser, Content: inputData},
-				},
-			},
-		)
-		if e != nil {
-			return "", e
-		}
-		resp = r
-		return "", nil
-	})
-	if err != nil {
-		logError(fmt.Sprintf("OpenAI API request failed: %s", err.Error()))
-		return "", GitAIException{"OpenAI API request failed: " + err.Error()}
-	}
-	if len(resp.Choices) == 0 {
-		logError("Received empty message from OpenAI")
-		return "", GitAIException{"No response from GPT"}
+// defaultModelFor returns the model used when none is configured explicitly.
+func defaultModelFor(provider string) string {
+	switch provider {
+	case "anthropic":
+		return "claude-3-5-haiku-latest"
+	case "ollama":
+		return "llama3"
+	default:
+		return "gpt-4o-mini"
 	}
-	logDebug("AI message generated successfully")
-	return resp.Choices[0].Message.Content, nil
 }
 
-func (g *GitAI) CheckRepoPermissions() error {
-	logDebug("Checking repository permissions via gh CLI")
-	out, err := runCmd("gh", "repo", "view", "--json", "viewerPermission")
-	if err != nil {
-		logDebug(out)
-		return GitAIException{"Cannot check repository permissions."}
-	}
-	var resp struct {
-		ViewerPermission string `json:"viewerPermission"`
+// configuredModel returns OPENAI_MODEL when set, or the default model of the
+// selected provider.
+func configuredModel() string {
+	if model := viper.GetString("OPENAI_MODEL"); model != "" {
+		return model
 	}
-	if unmarshalErr := json.Unmarshal([]byte(out), &resp); unmarshalErr != nil {
-		return GitAIException{"Cannot parse GH repo view output: " + unmarshalErr.Error()}
+	return defaultModelFor(viper.GetString("GAI_PROVIDER"))
+}
+
+// diffFileRe matches the file header of every file in a unified git diff.
+var diffFileRe = regexp.MustCompile(`(?m)^diff --git a/\S+ b/(\S+)$`)
+
+func changedFilesFromDiff(diff string) []string {
+	var files []string
+	for _, m := range diffFileRe.FindAllStringSubmatch(diff, -1) {
+		files = append(files, m[1])
 	}
-	switch resp.ViewerPermission {
-	case "ADMIN", "MAINTAIN", "WRITE":
-		return nil
-	default:
-		return GitAIException{
-			"You do not have write permissions to this repository. Permission: " + resp.ViewerPermission,
+	return files
+}
+
+// routeModel picks the model from MODEL_ROUTES ("*.go=gpt-4o,docs/*=gpt-4o-mini")
+// whose pattern matches the most changed files, falling back to the configured
+// model.
+func routeModel(files []string) string {
+	model := configuredModel()
+	best := 0
+	for _, route := range strings.Split(viper.GetString("MODEL_ROUTES"), ",") {
+		pattern, target, ok := strings.Cut(strings.TrimSpace(route), "=")
+		if !ok {
+			continue
+		}
+		matches := 0
+		for _, file := range files {
+			fullMatch, _ := filepath.Match(pattern, file)
+			baseMatch, _ := filepath.Match(pattern, filepath.Base(file))
+			if fullMatch || baseMatch {
+				matches++
+			}
+		}
+		if matches > best {
+			best, model = matches, strings.TrimSpace(target)
 		}
 	}
+	return model
 }
-func (g *GitAI) editContentInEditor(initialContent string) (string, bool) {
-	tmpFile, err := ioutil.TempFile("", "gai-*.txt")
-	if err != nil {
-		logError(fmt.Sprintf("Failed to create temp file: %s", err.Error()))
-		return "", false
+
+type GitAI struct {
+	gitOps   *GitOperations
+	provider Provider
+	// pushGit and forge are what Push depends on, so the push flow can run
+	// against fakes.
+	pushGit PushGit
+	forge   Forge
+}
+
+// Provider generates a message with an AI backend from the system
+// instructions, the user instructions and the input data, tuned by opts. Every
+// backend maps them to its own API. Besides the message it returns the token
+// usage, which METRICS_FILE and gai stats are built on.
+type Provider interface {
+	Generate(ctx context.Context, system, user, input string, opts GenerateOptions) (string, Usage, error)
+}
+
+// candidateProvider is implemented by providers that return several
+// alternative messages in one request.
+type candidateProvider interface {
+	GenerateCandidates(ctx context.Context, system, user, input string, opts GenerateOptions, n int) ([]string, Usage, error)
+}
+
+// GenerateOptions are the model and sampling settings of one generation,
+// independent of the provider.
+type GenerateOptions struct {
+	Model            string
+	MaxTokens        int
+	Temperature      float32
+	TopP             float32
+	FrequencyPenalty float32
+	PresencePenalty  float32
+	// Seed, when set, asks for deterministic sampling.
+	Seed *int
+}
+
+// Usage counts the tokens of one generation.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+type openAIProvider struct{ client *openai.Client }
+
+// chatRequest builds the chat completion request shared by GenerateCandidates and
+// StreamMessage.
+func (p *openAIProvider) chatRequest(system, user, input string, opts GenerateOptions) openai.ChatCompletionRequest {
+	return openai.ChatCompletionRequest{
+		Model:            opts.Model,
+		MaxTokens:        opts.MaxTokens,
+		Temperature:      opts.Temperature,
+		TopP:             opts.TopP,
+		FrequencyPenalty: opts.FrequencyPenalty,
+		PresencePenalty:  opts.PresencePenalty,
+		Seed:             opts.Seed,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: system},
+			{Role: openai.ChatMessageRoleUser, Content: user},
+			{Role: openai.ChatMessageRoleUser, Content: input},
+		},
 	}
-	defer os.Remove(tmpFile.Name())
+}
 
-	if _, err := tmpFile.WriteString(initialContent); err != nil {
-		logError(fmt.Sprintf("Failed to write to temp file: %s", err.Error()))
-		return "", false
+func (p *openAIProvider) Generate(ctx context.Context, system, user, input string, opts GenerateOptions) (string, Usage, error) {
+	messages, usage, err := p.GenerateCandidates(ctx, system, user, input, opts, 1)
+	if err != nil || len(messages) == 0 {
+		return "", usage, err
 	}
-	tmpFile.Close()
+	return messages[0], usage, nil
+}
 
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = os.Getenv("VISUAL")
+// GenerateCandidates asks for n choices with the n parameter of the API.
+func (p *openAIProvider) GenerateCandidates(ctx context.Context, system, user, input string, opts GenerateOptions, n int) ([]string, Usage, error) {
+	req := p.chatRequest(system, user, input, opts)
+	if n > 1 {
+		req.N = n
 	}
-	if editor == "" {
-		editor = "nano"
+	resp, err := p.client.CreateChatCompletion(ctx, req)
+	usage := Usage{PromptTokens: resp.Usage.PromptTokens, CompletionTokens: resp.Usage.CompletionTokens}
+	if err != nil {
+		return nil, usage, err
 	}
-
-	logMessage(color.FgBlue, fmt.Sprintf("✍️ Opening %s editor for final review...", color.New(color.Bold).Sprint(editor)))
-	cmd := exec.Command(editor, tmpFile.Name())
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logError(fmt.Sprintf("Failed to launch %s: %s", editor, err.Error()))
-		return "", false
+	var messages []string
+	for _, choice := range resp.Choices {
+		messages = append(messages, choice.Message.Content)
 	}
+	return messages, usage, nil
+}
 
-	finalContent, err := ioutil.ReadFile(tmpFile.Name())
+func (p *openAIProvider) ListModels(ctx context.Context) ([]string, error) {
+	list, err := p.client.ListModels(ctx)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to read updated file: %s", err.Error()))
-		return "", false
+		return nil, err
 	}
-
-	if strings.TrimSpace(string(finalContent)) == "" {
-		logMessage(color.FgYellow, "⚠️ No changes saved in the editor")
-		return string(finalContent), false
+	var models []string
+	for _, model := range list.Models {
+		models = append(models, model.ID)
 	}
+	return models, nil
+}
 
-	logDebug("User saved new content. Displaying below.")
-	fmt.Println()
-	color.New(color.Bold).Println(string(finalContent))
+// ollamaProvider calls the /api/chat endpoint of a local Ollama server.
+type ollamaProvider struct {
+	host string
+}
 
-	return string(finalContent), true
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
 }
 
-func (g *GitAI) generateDiffBasedMessage(staged bool) (string, bool) {
-	logDebug("Gathering diff for AI-based message")
-	diff, _ := g.gitOps.GetDiff(staged)
-	userData := buildInputData("", "", "", "", diff)
-	logDebug("Generating message with AI based on diff")
-	aiOutput, err := g.GenerateMessage(embeddedSystemInstructions, embeddedCommitFormattingInstructions, userData)
-	if err != nil {
-		logError(fmt.Sprintf("OpenAI error: %s", err.Error()))
-		return "", false
-	}
-	logMessage(color.FgCyan, "🔍 Review AI-generated message (Vim will open)...")
-	edited, saved := g.editContentInEditor(aiOutput)
-	return edited, saved
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Options  map[string]any  `json:"options,omitempty"`
 }
 
-func (g *GitAI) Commit(extraArgs []string) error {
-	logMessage(color.FgBlue, "📦 Starting commit process...")
-	hasChanges, err := g.gitOps.HasChanges()
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+// Generate sends the system message and the two user messages without
+// streaming, and maps the sampling settings to the Ollama options.
+func (p *ollamaProvider) Generate(ctx context.Context, system, user, input string, opts GenerateOptions) (string, Usage, error) {
+	body := ollamaRequest{
+		Model: opts.Model,
+		Messages: []ollamaMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: user},
+			{Role: "user", Content: input},
+		},
+		Options: map[string]any{
+			"temperature":       opts.Temperature,
+			"top_p":             opts.TopP,
+			"frequency_penalty": opts.FrequencyPenalty,
+			"presence_penalty":  opts.PresencePenalty,
+		},
+	}
+	if opts.MaxTokens > 0 {
+		body.Options["num_predict"] = opts.MaxTokens
+	}
+	if opts.Seed != nil {
+		body.Options["seed"] = *opts.Seed
+	}
+	payload, err := json.Marshal(body)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
-		return err
+		return "", Usage{}, err
 	}
-	if !hasChanges {
-		logMessage(color.FgYellow, "ℹ️ Nothing to commit. Exiting.")
-		return nil
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.host, "/")+"/api/chat", bytes.NewReader(payload))
+	if err != nil {
+		return "", Usage{}, err
 	}
-	if err := g.stageChangesIfNeeded(); err != nil {
-		return err
+	httpReq.Header.Set("content-type", "application/json")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", Usage{}, fmt.Errorf("cannot reach Ollama at %s: %w", p.host, err)
 	}
-	finalMessage, ok := g.generateDiffBasedMessage(true)
-	if !ok {
-		logMessage(color.FgYellow, "🚫 Commit canceled by user.")
-		return nil
+	defer httpResp.Body.Close()
+	var resp ollamaResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return "", Usage{}, fmt.Errorf("invalid Ollama response (status %d): %w", httpResp.StatusCode, err)
 	}
-	logDebug("Committing changes with final message")
-	return g.gitOps.Commit(finalMessage, extraArgs)
+	if resp.Error != "" {
+		return "", Usage{}, fmt.Errorf("ollama (status %d): %s", httpResp.StatusCode, resp.Error)
+	}
+	return resp.Message.Content, Usage{PromptTokens: resp.PromptEvalCount, CompletionTokens: resp.EvalCount}, nil
+}
+
+func (p *ollamaProvider) ListModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.host, "/")+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach Ollama at %s: %w", p.host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing Ollama models failed with status %d", resp.StatusCode)
+	}
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, err
+	}
+	var models []string
+	for _, model := range tags.Models {
+		models = append(models, model.Name)
+	}
+	return models, nil
+}
+
+// anthropicMaxTokens caps max_tokens to the output limit of the smallest Claude
+// models, since the Messages API rejects larger values.
+const anthropicMaxTokens = 8192
+
+// anthropicProvider calls the Anthropic Messages API.
+type anthropicProvider struct {
+	apiKey  string
+	baseURL string
+}
+
+type anthropicContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicMessage struct {
+	Role    string             `json:"role"`
+	Content []anthropicContent `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	TopP        *float32           `json:"top_p,omitempty"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicContent `json:"content"`
+	StopReason string             `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) ListModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.baseURL, "/")+"/v1/models?limit=1000", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing Anthropic models failed with status %d", resp.StatusCode)
+	}
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	var models []string
+	for _, model := range list.Data {
+		models = append(models, model.ID)
+	}
+	return models, nil
+}
+
+// Generate sends the system instructions as the system prompt and the user
+// instructions and input as one user message. The temperature is capped to
+// the 0-1 range of the Messages API and top_p is only sent when it narrows the
+// sampling.
+func (p *anthropicProvider) Generate(ctx context.Context, system, user, input string, opts GenerateOptions) (string, Usage, error) {
+	body := anthropicRequest{Model: opts.Model, MaxTokens: opts.MaxTokens, System: system}
+	if body.MaxTokens <= 0 || body.MaxTokens > anthropicMaxTokens {
+		body.MaxTokens = anthropicMaxTokens
+	}
+	body.Messages = []anthropicMessage{{Role: "user", Content: []anthropicContent{
+		{Type: "text", Text: user},
+		{Type: "text", Text: input},
+	}}}
+	temperature := min(opts.Temperature, 1)
+	body.Temperature = &temperature
+	if opts.TopP > 0 && opts.TopP < 1 {
+		body.TopP = &opts.TopP
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(p.baseURL, "/")+"/v1/messages", bytes.NewReader(payload))
+	if err != nil {
+		return "", Usage{}, err
+	}
+	httpReq.Header.Set("content-type", "application/json")
+	httpReq.Header.Set("x-api-key", p.apiKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer httpResp.Body.Close()
+	var resp anthropicResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return "", Usage{}, fmt.Errorf("invalid Anthropic response (status %d): %w", httpResp.StatusCode, err)
+	}
+	if resp.Error != nil {
+		return "", Usage{}, fmt.Errorf("anthropic %s (status %d): %s", resp.Error.Type, httpResp.StatusCode, resp.Error.Message)
+	}
+	var text strings.Builder
+	for _, content := range resp.Content {
+		if content.Type == "text" {
+			text.WriteString(content.Text)
+		}
+	}
+	return text.String(), Usage{PromptTokens: resp.Usage.InputTokens, CompletionTokens: resp.Usage.OutputTokens}, nil
+}
+
+// Generation tasks. Each one can override OPENAI_TEMPERATURE with
+// TEMPERATURE_<task>, e.g. TEMPERATURE_PR_BODY.
+const (
+	taskCommit       = "COMMIT"
+	taskStash        = "STASH"
+	taskPRTitle      = "PR_TITLE"
+	taskPRBody       = "PR_BODY"
+	taskReleaseNotes = "RELEASE_NOTES"
+	taskReview       = "REVIEW"
+	taskGitignore    = "GITIGNORE"
+)
+
+// temperatureFor returns TEMPERATURE_<task> when set, or OPENAI_TEMPERATURE.
+func temperatureFor(task string) float32 {
+	key := "TEMPERATURE_" + task
+	if viper.IsSet(key) {
+		logDebug(fmt.Sprintf("Using %s=%v", key, viper.GetFloat64(key)))
+		return float32(viper.GetFloat64(key))
+	}
+	return float32(viper.GetFloat64("OPENAI_TEMPERATURE"))
+}
+
+// generateOptions resolves the model and sampling settings of the task,
+// shared by GenerateMessage and StreamMessage.
+func generateOptions(task, inputData string) GenerateOptions {
+	model := routeModel(changedFilesFromDiff(inputData))
+	logDebug(fmt.Sprintf("Using model %s", model))
+	opts := GenerateOptions{
+		Model:            model,
+		MaxTokens:        viper.GetInt("OPENAI_MAX_TOKENS"),
+		Temperature:      temperatureFor(task),
+		TopP:             float32(viper.GetFloat64("OPENAI_TOP_P")),
+		FrequencyPenalty: float32(viper.GetFloat64("OPENAI_FREQUENCY_PENALTY")),
+		PresencePenalty:  float32(viper.GetFloat64("OPENAI_PRESENCE_PENALTY")),
+	}
+	if viper.IsSet("OPENAI_SEED") {
+		seed := viper.GetInt("OPENAI_SEED")
+		opts.Seed = &seed
+		logDebug(fmt.Sprintf("Using seed %d", seed))
+	}
+	return opts
+}
+
+// GenerateMessage generates a message in a single call, or in two when both
+// DRAFT_MODEL and REFINE_MODEL are set: the draft model writes the message from
+// the input and the refine model rewrites the draft to follow the rules.
+func (g *GitAI) GenerateMessage(task, systemInstructions, userInstructions, inputData string) (string, error) {
+	if err := checkPrivacy(len(inputData)); err != nil {
+		return "", err
+	}
+	opts := generateOptions(task, inputData)
+	draftModel, refineModel := viper.GetString("DRAFT_MODEL"), viper.GetString("REFINE_MODEL")
+	if draftModel == "" || refineModel == "" {
+		// With only one of them set, that model makes the single call
+		if model := draftModel + refineModel; model != "" {
+			opts.Model = model
+		}
+		message, _, err := g.complete(systemInstructions, userInstructions, inputData, opts)
+		return message, err
+	}
+
+	opts.Model = draftModel
+	draft, usage, err := g.complete(systemInstructions, userInstructions, inputData, opts)
+	if err != nil {
+		return "", err
+	}
+	logMessage(color.FgCyan, fmt.Sprintf("📊 Draft by %s: %d prompt + %d completion tokens", draftModel, usage.PromptTokens, usage.CompletionTokens))
+	// The refiner gets the input too, so it can correct facts of the draft
+	refineInput := fmt.Sprintf("%s\nDRAFT MESSAGE:\n%s\n\n"+
+		"Rewrite the draft so it follows every requirement above and is accurate to the input. Return only the final message.", inputData, draft)
+	opts.Model = refineModel
+	message, usage, err := g.complete(systemInstructions, userInstructions, refineInput, opts)
+	if err != nil {
+		return "", err
+	}
+	logMessage(color.FgCyan, fmt.Sprintf("📊 Refined by %s: %d prompt + %d completion tokens", refineModel, usage.PromptTokens, usage.CompletionTokens))
+	return message, nil
+}
+
+// privacyAcknowledged is set once the user accepted sending an input above
+// PRIVACY_WARN_BYTES, so the warning is shown only once per run.
+var privacyAcknowledged bool
+
+// checkPrivacy warns when more than PRIVACY_WARN_BYTES are about to be sent to
+// the model and asks for confirmation unless --yes is set or stdin is not a
+// terminal, in which case it only logs the warning.
+func checkPrivacy(size int) error {
+	limit := viper.GetInt("PRIVACY_WARN_BYTES")
+	if limit <= 0 || size <= limit || privacyAcknowledged {
+		return nil
+	}
+	logMessage(color.FgYellow, fmt.Sprintf("⚠️ About to send %d bytes of code to the model, above PRIVACY_WARN_BYTES (%d).", size, limit))
+	privacyAcknowledged = true
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return nil
+	}
+	if !confirm("Send it anyway?") {
+		return GitAIException{"Canceled: input exceeds PRIVACY_WARN_BYTES"}
+	}
+	return nil
+}
+
+// complete generates one message and returns it with the token usage.
+func (g *GitAI) complete(system, user, input string, opts GenerateOptions) (string, Usage, error) {
+	messages, usage, err := g.completeChoices(system, user, input, opts, 1)
+	if err != nil {
+		return "", usage, err
+	}
+	return messages[0], usage, nil
+}
+
+// GenerateCandidates generates n alternative messages, in one request on
+// providers that support it and in n requests on the others.
+func (g *GitAI) GenerateCandidates(task, systemInstructions, userInstructions, inputData string, n int) ([]string, error) {
+	if err := checkPrivacy(len(inputData)); err != nil {
+		return nil, err
+	}
+	opts := generateOptions(task, inputData)
+	if _, ok := g.provider.(candidateProvider); ok {
+		messages, _, err := g.completeChoices(systemInstructions, userInstructions, inputData, opts, n)
+		return messages, err
+	}
+	var messages []string
+	for i := 0; i < n; i++ {
+		message, _, err := g.complete(systemInstructions, userInstructions, inputData, opts)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// completeChoices generates n messages, in one request when n is above 1 and
+// the provider is a candidateProvider, retrying with a smaller diff on context
+// length errors. It returns the messages with the token usage.
+func (g *GitAI) completeChoices(system, user, input string, opts GenerateOptions, n int) ([]string, Usage, error) {
+	var messages []string
+	var usage Usage
+	var err error
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		_, err = performWithSpinner("🤖 Generating AI message", func() (string, error) {
+			ctx, cancel := aiContext()
+			defer cancel()
+			var e error
+			if multi, ok := g.provider.(candidateProvider); ok && n > 1 {
+				messages, usage, e = multi.GenerateCandidates(ctx, system, user, input, opts, n)
+			} else {
+				var message string
+				message, usage, e = g.provider.Generate(ctx, system, user, input, opts)
+				messages = []string{message}
+			}
+			if e != nil {
+				return "", timeoutError(ctx, e)
+			}
+			return "", nil
+		})
+		recordMetrics(metricsRecord{
+			Timestamp:        start.UTC(),
+			Command:          activeCommand,
+			Model:            opts.Model,
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			LatencyMs:        time.Since(start).Milliseconds(),
+			Success:          err == nil && len(messages) > 0 && messages[0] != "",
+		})
+		if err == nil || attempt == contextRetries || !isContextLengthError(err) {
+			break
+		}
+		truncated, size, ok := halveDiff(input)
+		if !ok {
+			break
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("✂️ Input exceeds the model context, retrying with the diff cut to %d characters...", size))
+		input = truncated
+	}
+	if err != nil {
+		logError(fmt.Sprintf("AI API request failed: %s", err.Error()))
+		return nil, usage, GitAIException{"AI API request failed: " + err.Error()}
+	}
+	if len(messages) == 0 || messages[0] == "" {
+		logError("Received empty message from the AI provider")
+		return nil, usage, GitAIException{"No response from GPT"}
+	}
+	logDebug("AI message generated successfully")
+	return messages, usage, nil
+}
+
+// StreamMessage generates a message like GenerateMessage but streams it,
+// passing every delta to onToken as it arrives. It returns the full message,
+// or the part received before the stream failed along with the error.
+func (g *GitAI) StreamMessage(task, systemInstructions, userInstructions, inputData string, onToken func(string)) (string, error) {
+	openAI, ok := g.provider.(*openAIProvider)
+	if !ok {
+		// Only the OpenAI API is streamed, other providers deliver the message at once
+		message, err := g.GenerateMessage(task, systemInstructions, userInstructions, inputData)
+		if err == nil {
+			onToken(message)
+		}
+		return message, err
+	}
+	if err := checkPrivacy(len(inputData)); err != nil {
+		return "", err
+	}
+	opts := generateOptions(task, inputData)
+	req := openAI.chatRequest(systemInstructions, userInstructions, inputData, opts)
+	req.Stream = true
+	req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	record := metricsRecord{Timestamp: time.Now().UTC(), Command: activeCommand, Model: req.Model}
+	defer func() {
+		record.LatencyMs = time.Since(record.Timestamp).Milliseconds()
+		recordMetrics(record)
+	}()
+
+	ctx, cancel := aiContext()
+	defer cancel()
+	stream, err := openAI.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return "", GitAIException{"OpenAI API request failed: " + timeoutError(ctx, err).Error()}
+	}
+	defer stream.Close()
+	message, err := readStream(stream, &record, onToken)
+	if err != nil {
+		return message, GitAIException{"OpenAI stream failed: " + timeoutError(ctx, err).Error()}
+	}
+	if message == "" {
+		return "", GitAIException{"No response from GPT"}
+	}
+	record.Success = true
+	return message, nil
+}
+
+// streamReceiver is the part of an OpenAI stream that readStream reads.
+type streamReceiver interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+}
+
+// readStream accumulates the deltas of the stream until it ends, passing each
+// one to onToken and the token usage to record. When the stream fails it
+// returns the text received so far with the error.
+func readStream(stream streamReceiver, record *metricsRecord, onToken func(string)) (string, error) {
+	var message strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return message.String(), nil
+		}
+		if err != nil {
+			return message.String(), err
+		}
+		if chunk.Usage != nil {
+			record.PromptTokens = chunk.Usage.PromptTokens
+			record.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		message.WriteString(chunk.Choices[0].Delta.Content)
+		onToken(chunk.Choices[0].Delta.Content)
+	}
+}
+
+// aiContext returns the context of one AI request, which expires after
+// GAI_TIMEOUT unless it is 0.
+func aiContext() (context.Context, context.CancelFunc) {
+	if timeout := aiTimeout(); timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// aiTimeout returns GAI_TIMEOUT. A bare number is taken as seconds like the
+// other *_SECONDS settings, where a duration would read it as nanoseconds.
+func aiTimeout() time.Duration {
+	if seconds, err := strconv.ParseFloat(strings.TrimSpace(viper.GetString("GAI_TIMEOUT")), 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return viper.GetDuration("GAI_TIMEOUT")
+}
+
+// timeoutError replaces the error of a request whose context expired with one
+// naming GAI_TIMEOUT.
+func timeoutError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("AI request timed out after %gs (GAI_TIMEOUT)", aiTimeout().Seconds())
+	}
+	return err
+}
+
+// contextRetries is how many times a request rejected for exceeding the model
+// context is retried with a halved diff.
+const contextRetries = 2
+
+func isContextLengthError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		if code, ok := apiErr.Code.(string); ok && code == "context_length_exceeded" {
+			return true
+		}
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "maximum context length") || strings.Contains(message, "prompt is too long")
+}
+
+const diffSectionHeader = "GIT DIFFERENCE TO HEAD:\n"
+
+// diffLinePrefixes are the line starts that can appear inside a git diff.
+var diffLinePrefixes = []string{"diff ", "index ", "@@", "+", "-", " ", "\\", "new ", "deleted ", "old ", "similarity ", "rename ", "copy ", "Binary "}
+
+func isDiffLine(line string) bool {
+	if line == "" {
+		return true
+	}
+	for _, prefix := range diffLinePrefixes {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// halveDiff cuts the diff section of the input built by buildInputData to
+// half its size on a line boundary, keeping the context that follows it. It
+// returns the new input and the size of the remaining diff.
+func halveDiff(input string) (string, int, bool) {
+	start := strings.Index(input, diffSectionHeader)
+	if start < 0 {
+		return input, 0, false
+	}
+	start += len(diffSectionHeader)
+	rest := input[start:]
+	end := len(rest)
+	offset := 0
+	for _, line := range strings.SplitAfter(rest, "\n") {
+		if !isDiffLine(strings.TrimSuffix(line, "\n")) {
+			end = offset
+			break
+		}
+		offset += len(line)
+	}
+	keep := strings.LastIndex(rest[:end/2], "\n") + 1
+	if keep == 0 {
+		return input, 0, false
+	}
+	return input[:start] + rest[:keep] + "[diff truncated]\n\n" + rest[end:], keep, true
+}
+
+// metricsRecord is one generation appended to METRICS_FILE.
+type metricsRecord struct {
+	Timestamp        time.Time `json:"timestamp"`
+	Command          string    `json:"command"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	LatencyMs        int64     `json:"latencyMs"`
+	Success          bool      `json:"success"`
+}
+
+var (
+	// activeCommand is the path of the running subcommand, e.g. "pr checkout".
+	activeCommand string
+	metricsWG     sync.WaitGroup
+	metricsMu     sync.Mutex
+)
+
+// recordMetrics appends the record to METRICS_FILE in the background, as CSV
+// when the file has a .csv extension and as JSON lines otherwise. Failures are
+// only logged in verbose mode.
+func recordMetrics(record metricsRecord) {
+	path := viper.GetString("METRICS_FILE")
+	if path == "" {
+		return
+	}
+	metricsWG.Add(1)
+	go func() {
+		defer metricsWG.Done()
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		if err := appendMetrics(path, record); err != nil {
+			logDebug(fmt.Sprintf("Failed to write metrics to %s: %s", path, err.Error()))
+		}
+	}()
+}
+
+func appendMetrics(path string, record metricsRecord) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(f)
+		if info, err := f.Stat(); err == nil && info.Size() == 0 {
+			_ = w.Write([]string{"timestamp", "command", "model", "prompt_tokens", "completion_tokens", "latency_ms", "success"})
+		}
+		_ = w.Write([]string{
+			record.Timestamp.Format(time.RFC3339),
+			record.Command,
+			record.Model,
+			strconv.Itoa(record.PromptTokens),
+			strconv.Itoa(record.CompletionTokens),
+			strconv.FormatInt(record.LatencyMs, 10),
+			strconv.FormatBool(record.Success),
+		})
+		w.Flush()
+		return w.Error()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readMetrics loads every record of the METRICS_FILE at path, in the CSV or
+// JSON lines format written by appendMetrics.
+func readMetrics(path string) ([]metricsRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []metricsRecord
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		rows, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			if i == 0 || len(row) < 7 {
+				continue
+			}
+			var record metricsRecord
+			record.Timestamp, _ = time.Parse(time.RFC3339, row[0])
+			record.Command, record.Model = row[1], row[2]
+			record.PromptTokens, _ = strconv.Atoi(row[3])
+			record.CompletionTokens, _ = strconv.Atoi(row[4])
+			record.LatencyMs, _ = strconv.ParseInt(row[5], 10, 64)
+			record.Success, _ = strconv.ParseBool(row[6])
+			records = append(records, record)
+		}
+		return records, nil
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record metricsRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			logDebug(fmt.Sprintf("Skipping invalid metrics line: %s", err.Error()))
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// modelPrices are the USD prices per million prompt and completion tokens
+// used to estimate the cost in gai stats.
+var modelPrices = map[string][2]float64{
+	"gpt-4o-mini":             {0.15, 0.60},
+	"gpt-4o":                  {2.50, 10.00},
+	"gpt-4.1":                 {2.00, 8.00},
+	"gpt-4.1-mini":            {0.40, 1.60},
+	"gpt-4.1-nano":            {0.10, 0.40},
+	"o3-mini":                 {1.10, 4.40},
+	"claude-3-5-haiku-latest": {0.80, 4.00},
+}
+
+// estimateCost returns the estimated USD cost of a record and whether the
+// model has a known price.
+func estimateCost(record metricsRecord) (float64, bool) {
+	price, ok := modelPrices[record.Model]
+	if !ok {
+		return 0, false
+	}
+	return (float64(record.PromptTokens)*price[0] + float64(record.CompletionTokens)*price[1]) / 1e6, true
+}
+
+// parseSince parses the stats --since value: a date (2006-01-02), a Go
+// duration (12h) or a number of days (7d).
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q, use a date (2006-01-02), a duration (12h) or days (7d)", value)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// systemInstructions returns the system prompt for a generation, prefixed with
+// the repository context file when the current repo ships one.
+func (g *GitAI) systemInstructions() string {
+	instructions := filterGitmoji(systemInstructionsContent)
+	if repoContext := g.loadRepoContext(); repoContext != "" {
+		instructions = fmt.Sprintf("PROJECT CONTEXT:\n%s\n\n%s", repoContext, instructions)
+	}
+	if preamble := promptPreamble(); preamble != "" {
+		instructions = preamble + "\n\n" + instructions
+	}
+	return instructions
+}
+
+// promptPreamble returns GLOBAL_PROMPT_PREAMBLE, read from the file it names
+// or used as inline text.
+func promptPreamble() string {
+	preamble := viper.GetString("GLOBAL_PROMPT_PREAMBLE")
+	if data, err := os.ReadFile(preamble); preamble != "" && err == nil {
+		preamble = string(data)
+	}
+	return strings.TrimSpace(preamble)
+}
+
+func (g *GitAI) loadRepoContext() string {
+	root, err := g.gitOps.GetRepoRoot()
+	if err != nil {
+		logDebug(fmt.Sprintf("Cannot determine repository root: %s", err.Error()))
+		return ""
+	}
+	path := filepath.Join(root, repoContextFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logError(fmt.Sprintf("Error reading repository context at %s: %s", path, err.Error()))
+		}
+		return ""
+	}
+	logDebug(fmt.Sprintf("Loaded repository context from %s", path))
+	return strings.TrimSpace(string(data))
+}
+
+// prTemplatePaths lists the locations GitHub looks for a pull request template,
+// relative to the repository root.
+var prTemplatePaths = []string{
+	".github/pull_request_template.md",
+	".github/PULL_REQUEST_TEMPLATE.md",
+	"docs/pull_request_template.md",
+	"docs/PULL_REQUEST_TEMPLATE.md",
+	"pull_request_template.md",
+	"PULL_REQUEST_TEMPLATE.md",
+}
+
+// findPRTemplate returns the path and content of the repository's pull
+// request template, or empty strings when there is none.
+func (g *GitAI) findPRTemplate() (string, string) {
+	root, err := g.gitOps.GetRepoRoot()
+	if err != nil {
+		return "", ""
+	}
+	for _, rel := range prTemplatePaths {
+		path := filepath.Join(root, rel)
+		if data, err := os.ReadFile(path); err == nil {
+			logDebug(fmt.Sprintf("Found PR template at %s", path))
+			return path, string(data)
+		}
+	}
+	return "", ""
+}
+
+// prBodyInstructions merges the PR body instructions with the repository's
+// pull request template when one exists.
+func (g *GitAI) prBodyInstructions() string {
+	instructions := prBodyFormattingInstructions
+	if sections := splitList(viper.GetString("PR_SECTIONS")); len(sections) > 0 {
+		instructions += prSectionsInstructions(sections)
+	} else if _, template := g.findPRTemplate(); strings.TrimSpace(template) != "" {
+		instructions = fmt.Sprintf("%s\n\nThe repository provides a pull request template. Fill in its sections instead of the OUTPUT FORMAT above:\n%s", instructions, template)
+	}
+	if samples := g.prStyleSamples(); len(samples) > 0 {
+		instructions += "\n\nMatch the tone and structure of these recently merged pull request descriptions of the repository:"
+		for i, sample := range samples {
+			instructions += fmt.Sprintf("\n\n--- EXAMPLE %d ---\n%s", i+1, sample)
+		}
+	}
+	return instructions
+}
+
+// prSectionsInstructions asks for exactly the PR_SECTIONS headings, in order.
+// Sections the model cannot fill are left out, or kept with "N/A" when
+// PR_EMPTY_SECTIONS is "na".
+func prSectionsInstructions(sections []string) string {
+	var format strings.Builder
+	for _, section := range sections {
+		fmt.Fprintf(&format, "### %s\n(...)\n\n", section)
+	}
+	empty := "Leave out a section entirely when the changes give you nothing to put in it."
+	if viper.GetString("PR_EMPTY_SECTIONS") == "na" {
+		empty = `Keep every section, writing "N/A" under a section the changes give you nothing to put in.`
+	}
+	return fmt.Sprintf("\n\n**SECTIONS (override the OUTPUT FORMAT above):**\n"+
+		"Use exactly these sections, in this order, as level 3 headings, and no other sections. %s\n\n%s",
+		empty, strings.TrimSpace(format.String()))
+}
+
+// prStyleSampleMaxChars caps every PR body example to keep the prompt small.
+const prStyleSampleMaxChars = 1500
+
+// prStyleSamples returns the bodies of the last PR_STYLE_SAMPLE_COUNT merged
+// pull requests, truncated to prStyleSampleMaxChars.
+func (g *GitAI) prStyleSamples() []string {
+	count := viper.GetInt("PR_STYLE_SAMPLE_COUNT")
+	if count <= 0 || !hasGH() {
+		return nil
+	}
+	out, err := runCmd("gh", "pr", "list", "--state", "merged", "--limit", strconv.Itoa(count), "--json", "body")
+	if err != nil {
+		logDebug(fmt.Sprintf("Failed to fetch merged PR bodies: %s", out))
+		return nil
+	}
+	var prs []struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal([]byte(out), &prs); err != nil {
+		logDebug(fmt.Sprintf("Failed to parse merged PR bodies: %s", err.Error()))
+		return nil
+	}
+	var samples []string
+	for _, pr := range prs {
+		body := strings.TrimSpace(pr.Body)
+		if body == "" {
+			continue
+		}
+		if len(body) > prStyleSampleMaxChars {
+			body = strings.ToValidUTF8(body[:prStyleSampleMaxChars], "") + "\n[truncated]"
+		}
+		samples = append(samples, body)
+	}
+	return samples
+}
+
+// permissionCacheEntry is a cached viewerPermission of one repository.
+type permissionCacheEntry struct {
+	Permission string    `json:"permission"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+func permissionCachePath() string {
+	return filepath.Join(configDir, "cache", "permissions.json")
+}
+
+func readPermissionCache() map[string]permissionCacheEntry {
+	cache := map[string]permissionCacheEntry{}
+	data, err := os.ReadFile(permissionCachePath())
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		logDebug(fmt.Sprintf("Ignoring corrupt permission cache: %s", err.Error()))
+		return map[string]permissionCacheEntry{}
+	}
+	return cache
+}
+
+func writePermissionCache(cache map[string]permissionCacheEntry) {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+	path := permissionCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		logDebug(fmt.Sprintf("Cannot create cache directory: %s", err.Error()))
+		return
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		logDebug(fmt.Sprintf("Cannot write permission cache: %s", err.Error()))
+	}
+}
+
+// viewerPermission returns the user's permission on the current repository,
+// served from the cache while it is younger than PERMISSION_CACHE_TTL.
+func (g *GitAI) viewerPermission(useCache bool) (string, error) {
+	remote, _ := runCmd("git", "remote", "get-url", "origin")
+	cache := readPermissionCache()
+	if entry, ok := cache[remote]; useCache && ok && remote != "" &&
+		time.Since(entry.CheckedAt) < viper.GetDuration("PERMISSION_CACHE_TTL") {
+		logDebug(fmt.Sprintf("Using cached repository permission %s", entry.Permission))
+		return entry.Permission, nil
+	}
+	logDebug("Checking repository permissions via gh CLI")
+	out, err := runCmd("gh", "repo", "view", "--json", "viewerPermission")
+	if err != nil {
+		logDebug(out)
+		return "", GitAIException{"Cannot check repository permissions."}
+	}
+	var resp struct {
+		ViewerPermission string `json:"viewerPermission"`
+	}
+	if unmarshalErr := json.Unmarshal([]byte(out), &resp); unmarshalErr != nil {
+		return "", GitAIException{"Cannot parse GH repo view output: " + unmarshalErr.Error()}
+	}
+	if remote != "" {
+		cache[remote] = permissionCacheEntry{Permission: resp.ViewerPermission, CheckedAt: time.Now()}
+		writePermissionCache(cache)
+	}
+	return resp.ViewerPermission, nil
+}
+
+func (g *GitAI) CheckRepoPermissions(useCache bool) error {
+	permission, err := g.viewerPermission(useCache)
+	if err != nil {
+		return err
+	}
+	switch permission {
+	case "ADMIN", "MAINTAIN", "WRITE":
+		return nil
+	default:
+		return GitAIException{
+			"You do not have write permissions to this repository. Permission: " + permission,
+		}
+	}
+}
+
+// reviewAIOutput lets the user review generated content in the editor, or
+// accepts it verbatim when GAI_NO_EDIT is set. Empty content is never accepted.
+func (g *GitAI) reviewAIOutput(content string) (string, bool) {
+	if !viper.GetBool("GAI_NO_EDIT") {
+		return g.editContentInEditor(content)
+	}
+	if strings.TrimSpace(content) == "" {
+		logMessage(color.FgYellow, "⚠️ AI output is empty. Nothing to accept without the editor.")
+		return "", false
+	}
+	logDebug("Accepting AI output without the editor (GAI_NO_EDIT)")
+	return content, true
+}
+
+func (g *GitAI) editContentInEditor(initialContent string) (string, bool) {
+	tmpFile, err := ioutil.TempFile("", "gai-*.txt")
+	if err != nil {
+		logError(fmt.Sprintf("Failed to create temp file: %s", err.Error()))
+		return "", false
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(initialContent); err != nil {
+		logError(fmt.Sprintf("Failed to write to temp file: %s", err.Error()))
+		return "", false
+	}
+	tmpFile.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = os.Getenv("VISUAL")
+	}
+	if editor == "" {
+		editor = "nano"
+	}
+
+	logMessage(color.FgBlue, fmt.Sprintf("✍️ Opening %s editor for final review...", color.New(color.Bold).Sprint(editor)))
+	cmd := exec.Command(editor, tmpFile.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	editorErr := cmd.Run()
+	if editorErr != nil && viper.GetBool("ABORT_ON_EDITOR_ERROR") {
+		logError(fmt.Sprintf("Failed to launch %s: %s", editor, editorErr.Error()))
+		return "", false
+	}
+
+	finalContent, err := ioutil.ReadFile(tmpFile.Name())
+	if err != nil {
+		logError(fmt.Sprintf("Failed to read updated file: %s", err.Error()))
+		return "", false
+	}
+
+	// A non-zero exit (e.g. :cq) only cancels when nothing was changed
+	if editorErr != nil {
+		if string(finalContent) == initialContent {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s exited with %s without changes", editor, editorErr.Error()))
+			return "", false
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s exited with %s, but the file was saved. Using it.", editor, editorErr.Error()))
+	}
+
+	if strings.TrimSpace(string(finalContent)) == "" {
+		logMessage(color.FgYellow, "⚠️ No changes saved in the editor")
+		return string(finalContent), false
+	}
+
+	logDebug("User saved new content. Displaying below.")
+	fmt.Fprintln(os.Stderr)
+	color.New(color.Bold).Fprintln(os.Stderr, string(finalContent))
+
+	return string(finalContent), true
+}
+
+// prTitleInstructions returns the PR title prompt, switched to the
+// conventional commit format when PR_TITLE_CONVENTIONAL is set.
+func prTitleInstructions() string {
+	instructions := prTitleFormattingInstructions
+	if viper.GetBool("PR_TITLE_CONVENTIONAL") {
+		instructions += `
+
+**CONVENTIONAL FORMAT (overrides the output format above):**
+Write the title as a conventional commit subject, "<gitmoji> type(scope): description", so it matches the commits when the PR is squash-merged.
+If a ticket number is provided, keep it in brackets before the conventional subject.
+
+**OUTPUT FORMAT:**
+[<ticket number>] <gitmoji> type(scope): <description>`
+	}
+	if viper.GetString("PR_TITLE_GITMOJI") == "none" {
+		instructions = strings.ReplaceAll(instructions, "<gitmoji> ", "") + `
+
+**NO GITMOJI (overrides the system instructions):**
+Do not use a gitmoji or any other emoji in the title, even though commits use them.`
+	}
+	return instructions
+}
+
+// stripTitleGitmoji removes the emoji the model may still put at the start of
+// a PR title, after the ticket, when PR_TITLE_GITMOJI is "none".
+func stripTitleGitmoji(title string) string {
+	if viper.GetString("PR_TITLE_GITMOJI") != "none" {
+		return title
+	}
+	prefix, rest := "", title
+	if strings.HasPrefix(title, "[") {
+		if end := strings.Index(title, "] "); end > 0 {
+			prefix, rest = title[:end+2], title[end+2:]
+		}
+	}
+	if emoji := leadingEmoji(rest); emoji != "" {
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, emoji))
+	}
+	return prefix + rest
+}
+
+// commitMoods maps COMMIT_MOOD values to the instruction replacing the default
+// imperative mood guidance.
+var commitMoods = map[string]string{
+	"past":    `Write in past tense (e.g., "added" instead of "add").`,
+	"present": `Write in present tense, third person (e.g., "adds" instead of "add").`,
+}
+
+// commitInstructions returns the commit prompt with the optional mood and body
+// instructions appended.
+func commitInstructions() string {
+	instructions := commitFormattingInstructions
+	if mood, ok := commitMoods[viper.GetString("COMMIT_MOOD")]; ok {
+		instructions += fmt.Sprintf("\n\n**MOOD (overrides the imperative mood requirement):**\n%s", mood)
+	}
+	if tmpl := commitOutputTemplate(); tmpl != "" {
+		instructions += fmt.Sprintf("\n\n**OUTPUT TEMPLATE (overrides the OUTPUT FORMAT and the single line requirement):**\n"+
+			"Fill in this template, replacing every <placeholder> and keeping everything else as is. "+
+			"Leave out a parenthesized placeholder that does not apply, and do not add a gitmoji unless the template has a <gitmoji> placeholder.\n%s", tmpl)
+	}
+	if viper.GetBool("COMMIT_FOCUS") {
+		instructions += "\n\n**FOCUS (overrides the single line requirement):**\n" +
+			"Identify the single most impactful change in the diff and describe only that change in the subject, even when many files changed. " +
+			"Treat refactors, renames and formatting done for it as supporting changes. " +
+			"After the subject, add a blank line and mention the supporting changes briefly in the body."
+	}
+	if !viper.GetBool("COMMIT_WITH_BODY") {
+		return instructions
+	}
+	body := "After the subject line, add a blank line and a short body in prose explaining what changed and why."
+	if viper.GetString("COMMIT_BODY_STYLE") == "bullets" {
+		body = `After the subject line, add a blank line and a body listing the changes as bullet points, one change per "- " line.
+
+**EXAMPLE:**
+✨ feat: add release notes command
+
+- add changelog command generating notes since the last tag
+- group notes by merged pull requests with --by-pr`
+	}
+	instructions = fmt.Sprintf("%s\n\n**BODY (overrides the single line requirement):**\n%s", instructions, body)
+	if maxLines := viper.GetInt("COMMIT_MAX_LINES"); maxLines > 0 {
+		instructions += fmt.Sprintf("\n\n**LENGTH:**\nThe whole message, subject included, must not exceed %d non-empty lines.", maxLines)
+	}
+	return instructions
+}
+
+// pickCandidate lists the candidate messages on stderr and reads the number of
+// the chosen one from in. Choosing 0 cancels.
+func pickCandidate(candidates []string, in io.Reader) (string, bool) {
+	logMessage(color.FgCyan, fmt.Sprintf("🎲 %d candidate messages:", len(candidates)))
+	for i, candidate := range candidates {
+		fmt.Fprintf(os.Stderr, "\n  %d) %s\n", i+1, strings.ReplaceAll(strings.TrimSpace(candidate), "\n", "\n     "))
+	}
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Fprintf(os.Stderr, "\nPick a message [1-%d, 0 cancels]: ", len(candidates))
+		answer, err := reader.ReadString('\n')
+		index, parseErr := parseCandidateChoice(answer, len(candidates))
+		if parseErr == nil {
+			if index == 0 {
+				return "", false
+			}
+			return candidates[index-1], true
+		}
+		if err != nil {
+			return "", false
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s", parseErr.Error()))
+	}
+}
+
+// parseCandidateChoice parses the number picked out of n candidates, where 0
+// means cancel.
+func parseCandidateChoice(answer string, n int) (int, error) {
+	index, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || index < 0 || index > n {
+		return 0, fmt.Errorf("enter a number from 0 to %d", n)
+	}
+	return index, nil
+}
+
+// streamToTerminal streams the message to stderr as it is generated, in place
+// of the spinner. When the stream breaks after some text arrived, the partial
+// message is returned with a note and partial set instead of failing, so it
+// can be finished in the editor.
+func (g *GitAI) streamToTerminal(task, instructions, userData string) (message string, partial bool, err error) {
+	logMessage(color.FgCyan, "🤖 Generating AI message...")
+	message, err = g.StreamMessage(task, g.systemInstructions(), instructions, userData, func(text string) {
+		fmt.Fprint(os.Stderr, text)
+	})
+	fmt.Fprintln(os.Stderr)
+	if err == nil || strings.TrimSpace(message) == "" {
+		return message, false, err
+	}
+	logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s. Keeping the partial message.", err.Error()))
+	if task == taskCommit {
+		message += fmt.Sprintf("\n\n# NOTE: The AI stream was interrupted (%s), the message above is incomplete.", err.Error())
+	}
+	return message, true, nil
+}
+
+// generateDiffBasedMessage generates and reviews a message for the staged or
+// unstaged diff. Every extra context line is appended to the input data.
+// commitInputData builds the model input for a commit message from the
+// staged diff, leaving out test files with EXCLUDE_TESTS, and the extra
+// context from commitContext.
+func commitInputData(diff string, extraContext []string) string {
+	if viper.GetBool("EXCLUDE_TESTS") {
+		diff = excludeTestFiles(diff)
+	}
+	userData := buildInputData("", "", "", "", diff)
+	for _, extra := range extraContext {
+		userData += extra + "\n"
+	}
+	return userData
+}
+
+func (g *GitAI) generateDiffBasedMessage(staged bool, extraContext ...string) (string, bool) {
+	logDebug("Gathering diff for AI-based message")
+	diff, _ := g.gitOps.GetDiff(staged)
+	var userData string
+	if staged {
+		userData = commitInputData(diff, extraContext)
+	} else {
+		userData = buildInputData("", "", "", "", diff)
+		for _, extra := range extraContext {
+			userData += extra + "\n"
+		}
+	}
+	logDebug("Generating message with AI based on diff")
+	task, instructions := taskStash, commitFormattingInstructions
+	if staged {
+		task, instructions = taskCommit, commitInstructions()
+	}
+	var aiOutput string
+	var partial bool
+	var err error
+	if n := viper.GetInt("COMMIT_CANDIDATES"); staged && n > 1 {
+		var candidates []string
+		if candidates, err = g.GenerateCandidates(task, g.systemInstructions(), instructions, userData, n); err == nil {
+			var picked bool
+			if aiOutput, picked = pickCandidate(candidates, os.Stdin); !picked {
+				return "", false
+			}
+		}
+	} else if viper.GetBool("GAI_STREAM") {
+		aiOutput, partial, err = g.streamToTerminal(task, instructions, userData)
+	} else {
+		aiOutput, err = g.GenerateMessage(task, g.systemInstructions(), instructions, userData)
+	}
+	if partial && viper.GetBool("GAI_NO_EDIT") {
+		logError("The AI stream was interrupted and the message is incomplete. Not accepting it without the editor.")
+		return "", false
+	}
+	offline := false
+	if err != nil {
+		logError(fmt.Sprintf("OpenAI error: %s", err.Error()))
+		if !staged || !viper.GetBool("OFFLINE_FALLBACK") {
+			return "", false
+		}
+		if viper.GetBool("GAI_NO_EDIT") {
+			logError("The offline fallback message is only a placeholder. Not accepting it without the editor.")
+			return "", false
+		}
+		numStat, statErr := g.gitOps.GetNumStat(true)
+		nameStatus, _ := g.gitOps.GetNameStatus(true)
+		if statErr != nil {
+			logError(fmt.Sprintf("Failed to get the diff stat: %s", statErr.Error()))
+			return "", false
+		}
+		logMessage(color.FgYellow, "⚠️ Falling back to an offline message built from the diff stat, NOT by AI")
+		aiOutput, offline = offlineCommitMessage(numStat, nameStatus)+"\n\n# NOTE: Offline fallback, this message was built from the diff stat without AI. A \""+offlineTrailer+"\" trailer marks it in the commit.", true
+	}
+	// Offline and partial messages are placeholders and always go through the editor
+	if staged && !offline && !partial && viper.GetBool("EDIT_ON_INVALID_ONLY") {
+		violations := append(validateCommitMessage(fixCommitMessage(aiOutput)), runValidators(fixCommitMessage(aiOutput))...)
+		if len(violations) == 0 {
+			logMessage(color.FgGreen, "✅ AI message passed validation. Skipping editor.")
+			return strings.TrimSpace(aiOutput), true
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ AI message failed validation (%s). Opening editor...", strings.Join(violations, "; ")))
+	}
+	if !viper.GetBool("GAI_NO_EDIT") {
+		if staged {
+			aiOutput += g.commitReviewComments()
+		}
+		logMessage(color.FgCyan, "🔍 Review AI-generated message (Vim will open)...")
+	}
+	edited, saved := g.reviewAIOutput(aiOutput)
+	if !saved || !staged {
+		return edited, saved
+	}
+	edited = stripComments(edited)
+	for {
+		var rejections []string
+		if maxLines := viper.GetInt("COMMIT_MAX_LINES"); maxLines > 0 && countMessageLines(edited) > maxLines {
+			rejections = append(rejections, fmt.Sprintf("message has %d lines, at most %d allowed (COMMIT_MAX_LINES)", countMessageLines(edited), maxLines))
+		}
+		if edited != "" {
+			subject, _ := splitCommitSubject(fixCommitMessage(edited))
+			if mismatch := gitmojiTypeMismatch(subject); mismatch != "" {
+				rejections = append(rejections, mismatch)
+			}
+			rejections = append(rejections, runValidators(fixCommitMessage(edited))...)
+		}
+		if len(rejections) == 0 {
+			break
+		}
+		if viper.GetBool("GAI_NO_EDIT") {
+			logError(fmt.Sprintf("Commit message rejected:\n  - %s", strings.Join(rejections, "\n  - ")))
+			return "", false
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Commit message rejected:\n  - %s\nReopening editor...", strings.Join(rejections, "\n  - ")))
+		if edited, saved = g.editContentInEditor(edited + rejectionComments(rejections) + g.commitReviewComments()); !saved {
+			return "", false
+		}
+		edited = stripComments(edited)
+	}
+	if edited == "" {
+		logMessage(color.FgYellow, "⚠️ Commit message is empty after removing comments")
+		return "", false
+	}
+	if offline {
+		// The NOTE comment is stripped, so the trailer is what keeps the commit
+		// recognisable as not written by AI
+		marked, err := g.gitOps.AddTrailer(edited, offlineTrailer)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to add the %s trailer: %s", offlineTrailer, err.Error()))
+			return "", false
+		}
+		edited = marked
+	}
+	return edited, true
+}
+
+// offlineTrailer marks commits whose message was built by the offline
+// fallback instead of the AI.
+const offlineTrailer = "Generated-by: gai offline fallback"
+
+// offlineCommitMessage builds a commit message from git diff --numstat and
+// --name-status output without AI: the kind of change, the directory with the
+// most changed lines as scope, the file count and the added and deleted line
+// counts.
+func offlineCommitMessage(numStat, nameStatus string) string {
+	type fileStat struct {
+		path           string
+		added, deleted int
+		binary         bool
+	}
+	var files []fileStat
+	dirLines := map[string]int{}
+	totalAdded, totalDeleted := 0, 0
+	statuses := map[byte]int{}
+	for _, line := range strings.Split(nameStatus, "\n") {
+		if line != "" {
+			statuses[line[0]]++
+		}
+	}
+	for _, line := range strings.Split(numStat, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		stat := fileStat{path: fields[2], binary: fields[0] == "-"}
+		stat.added, _ = strconv.Atoi(fields[0])
+		stat.deleted, _ = strconv.Atoi(fields[1])
+		totalAdded += stat.added
+		totalDeleted += stat.deleted
+		if dir, _, found := strings.Cut(stat.path, "/"); found {
+			dirLines[dir] += stat.added + stat.deleted + 1
+		}
+		files = append(files, stat)
+	}
+	primary := ""
+	for dir, lines := range dirLines {
+		if lines > dirLines[primary] || (lines == dirLines[primary] && dir < primary) {
+			primary = dir
+		}
+	}
+	scope := ""
+	if primary != "" {
+		scope = "(" + primary + ")"
+	}
+	noun := "files"
+	if len(files) == 1 {
+		noun = "file"
+	}
+	subject := fmt.Sprintf("🔧 chore%s: update %d %s", scope, len(files), noun)
+	switch {
+	case len(files) > 0 && statuses['A'] == len(files):
+		subject = fmt.Sprintf("✨ feat%s: add %d %s", scope, len(files), noun)
+	case len(files) > 0 && statuses['D'] == len(files):
+		subject = fmt.Sprintf("🔥 refactor%s: remove %d %s", scope, len(files), noun)
+	}
+	subject += fmt.Sprintf(" (+%d/-%d)", totalAdded, totalDeleted)
+	var body strings.Builder
+	for _, stat := range files {
+		if stat.binary {
+			body.WriteString(fmt.Sprintf("\n- %s (binary)", stat.path))
+			continue
+		}
+		body.WriteString(fmt.Sprintf("\n- %s (+%d/-%d)", stat.path, stat.added, stat.deleted))
+	}
+	return subject + "\n" + body.String()
+}
+
+// rejectionComments lists the reasons a message was rejected as comment
+// lines, shown when the editor is reopened.
+func rejectionComments(rejections []string) string {
+	var b strings.Builder
+	b.WriteString("\n\n# The message was rejected:")
+	for _, rejection := range rejections {
+		for _, line := range strings.Split(rejection, "\n") {
+			b.WriteString("\n#   " + line)
+		}
+	}
+	return b.String()
+}
+
+// runValidators pipes the message into every command listed in VALIDATORS
+// and returns the output of the ones that exit non-zero.
+func runValidators(message string) []string {
+	var failures []string
+	for _, validator := range splitList(viper.GetString("VALIDATORS")) {
+		cmd := exec.Command("sh", "-c", validator)
+		cmd.Stdin = strings.NewReader(message)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			continue
+		}
+		logDebug(fmt.Sprintf("Validator %q failed: %s", validator, err.Error()))
+		reason := strings.TrimSpace(string(out))
+		if reason == "" {
+			reason = err.Error()
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", validator, reason))
+	}
+	return failures
+}
+
+// commitReviewComments builds git-style comment lines listing the staged files
+// and diff stat, appended below the message while it is being edited.
+func (g *GitAI) commitReviewComments() string {
+	var b strings.Builder
+	b.WriteString("\n\n# Please review the commit message. Lines starting with '#' will be ignored.\n#\n")
+	if files, err := g.gitOps.GetNameStatus(true); err == nil && files != "" {
+		b.WriteString("# Changes to be committed:\n")
+		for _, line := range strings.Split(files, "\n") {
+			b.WriteString("#\t" + line + "\n")
+		}
+		b.WriteString("#\n")
+	}
+	if stat, err := g.gitOps.GetDiffStat(true); err == nil && stat != "" {
+		stat = truncateDiffStat(stat, viper.GetInt("DIFF_STAT_MAX_LINES"))
+		for _, line := range strings.Split(stat, "\n") {
+			b.WriteString("# " + line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// truncateDiffStat keeps the first maxFiles file lines of a git diff --stat
+// and its summary line, replacing the rest with a count. A maxFiles of 0 or
+// less keeps everything.
+func truncateDiffStat(stat string, maxFiles int) string {
+	lines := strings.Split(stat, "\n")
+	files, summary := lines[:len(lines)-1], lines[len(lines)-1]
+	if maxFiles <= 0 || len(files) <= maxFiles {
+		return stat
+	}
+	kept := append([]string{}, files[:maxFiles]...)
+	kept = append(kept, fmt.Sprintf(" ... and %d more", len(files)-maxFiles), summary)
+	return strings.Join(kept, "\n")
+}
+
+// stripComments removes the '#'-prefixed lines git would ignore and trims the
+// surrounding whitespace.
+func stripComments(msg string) string {
+	var kept []string
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+// commitSubjectRe splits a "<gitmoji> type(scope): description" subject into
+// its prefix and the description.
+var commitSubjectRe = regexp.MustCompile(`^((?:\S+\s+)?[a-zA-Z]+(?:\([^)]*\))?!?:\s+)(\S.*)$`)
+
+func splitCommitSubject(message string) (subject, rest string) {
+	parts := strings.SplitN(message, "\n", 2)
+	if len(parts) == 2 {
+		return parts[0], "\n" + parts[1]
+	}
+	return parts[0], ""
+}
+
+// applySubjectCase rewrites the first letter of the description according to
+// COMMIT_SUBJECT_CASE. Acronyms such as "API" are left untouched in lower mode.
+func applySubjectCase(description string) string {
+	runes := []rune(description)
+	if len(runes) == 0 {
+		return description
+	}
+	switch viper.GetString("COMMIT_SUBJECT_CASE") {
+	case "lower":
+		if len(runes) > 1 && unicode.IsUpper(runes[1]) {
+			return description
+		}
+		runes[0] = unicode.ToLower(runes[0])
+	case "sentence":
+		runes[0] = unicode.ToUpper(runes[0])
+	}
+	return string(runes)
+}
+
+// fixCommitMessage auto-corrects the parts of the message that can be fixed
+// without user interaction.
+func fixCommitMessage(message string) string {
+	subject, rest := splitCommitSubject(message)
+	subject = fixGitmojiType(subject)
+	m := commitSubjectRe.FindStringSubmatch(subject)
+	if m == nil {
+		return subject + rest
+	}
+	return m[1] + applySubjectCase(m[2]) + rest
+}
+
+// defaultGitmojiTypeMap pairs the gitmoji of the system instructions with the
+// conventional commit types they stand for.
+const defaultGitmojiTypeMap = "✨=feat,🎉=feat,💥=feat,🚩=feat,🌐=feat,♿️=feat,💄=style,🎨=style,🚨=style," +
+	"🐛=fix,🚑️=fix,🩹=fix,🔒️=fix,🥅=fix,✏️=fix,📝=docs,💡=docs,♻️=refactor,🚚=refactor,🔥=refactor,⚰️=refactor," +
+	"🏗️=refactor,⚡️=perf,✅=test,🧪=test,📸=test,🤡=test,👷=ci,💚=ci,📦️=build,⬆️=build,⬇️=build,📌=build,➕=build," +
+	"➖=build,🔧=chore,🔨=chore,🙈=chore,🔖=chore,👥=chore,⏪️=revert"
+
+// gitmojiTypeMap parses GITMOJI_TYPE_MAP into the normalized gitmoji and the
+// types each may pair with. An emoji listed several times allows each type.
+// It returns nil when GITMOJI_TYPE_MAP is "none".
+func gitmojiTypeMap() map[string][]string {
+	value := viper.GetString("GITMOJI_TYPE_MAP")
+	if value == "none" {
+		return nil
+	}
+	pairs := map[string][]string{}
+	for _, entry := range splitList(value) {
+		if emoji, commitType, ok := strings.Cut(entry, "="); ok {
+			key := normalizeEmoji(strings.TrimSpace(emoji))
+			pairs[key] = append(pairs[key], strings.ToLower(strings.TrimSpace(commitType)))
+		}
+	}
+	return pairs
+}
+
+// gitmojiTypeRe captures the gitmoji and the type of a conventional subject.
+var gitmojiTypeRe = regexp.MustCompile(`^(\S+)(\s+)([a-zA-Z]+)((?:\([^)]*\))?!?:)`)
+
+// gitmojiTypeMismatch describes the disagreement between the gitmoji and the
+// type of the subject according to GITMOJI_TYPE_MAP, or returns an empty
+// string when they agree or the gitmoji is not mapped.
+func gitmojiTypeMismatch(subject string) string {
+	m := gitmojiTypeRe.FindStringSubmatch(subject)
+	if m == nil || leadingEmoji(subject) == "" {
+		return ""
+	}
+	types, ok := gitmojiTypeMap()[normalizeEmoji(m[1])]
+	if !ok || slices.Contains(types, strings.ToLower(m[3])) {
+		return ""
+	}
+	return fmt.Sprintf("gitmoji %s must be paired with %s, not %s (GITMOJI_TYPE_MAP)", m[1], strings.Join(types, " or "), m[3])
+}
+
+// fixGitmojiType resolves a gitmoji/type mismatch of the subject as set by
+// GITMOJI_TYPE_MISMATCH: "emoji" replaces the gitmoji with the first one
+// mapped to the type, "type" replaces the type with the one of the gitmoji,
+// and "reject" leaves the subject for validation to report.
+func fixGitmojiType(subject string) string {
+	if gitmojiTypeMismatch(subject) == "" {
+		return subject
+	}
+	m := gitmojiTypeRe.FindStringSubmatch(subject)
+	pairs := gitmojiTypeMap()
+	switch viper.GetString("GITMOJI_TYPE_MISMATCH") {
+	case "emoji":
+		for _, entry := range splitList(viper.GetString("GITMOJI_TYPE_MAP")) {
+			if emoji, commitType, ok := strings.Cut(entry, "="); ok && strings.EqualFold(strings.TrimSpace(commitType), m[3]) {
+				return strings.TrimSpace(emoji) + m[2] + subject[len(m[1])+len(m[2]):]
+			}
+		}
+	case "type":
+		commitType := pairs[normalizeEmoji(m[1])][0]
+		return m[1] + m[2] + commitType + subject[len(m[0])-len(m[4]):]
+	}
+	return subject
+}
+
+// commitOutputTemplates are the built-in COMMIT_OUTPUT_TEMPLATE values.
+var commitOutputTemplates = map[string]string{
+	"gitmoji":      "<gitmoji> <type>(<scope>): <description>",
+	"conventional": "<type>(<scope>): <description>\n\n<body>",
+	"angular":      "<type>(<scope>): <description>\n\n<body>\n\n<footer>",
+}
+
+// commitOutputTemplate resolves COMMIT_OUTPUT_TEMPLATE to a built-in template
+// or the custom one, where a literal \n stands for a line break.
+func commitOutputTemplate() string {
+	value := viper.GetString("COMMIT_OUTPUT_TEMPLATE")
+	if builtin, ok := commitOutputTemplates[value]; ok {
+		return builtin
+	}
+	return strings.ReplaceAll(value, `\n`, "\n")
+}
+
+var templatePlaceholderRe = regexp.MustCompile(`<[a-z_]+>`)
+
+// templateSubjectRe turns the first line of the template into a regex where
+// every placeholder matches any text and a "(<placeholder>)" is optional.
+func templateSubjectRe(tmpl string) *regexp.Regexp {
+	first := strings.SplitN(tmpl, "\n", 2)[0]
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, loc := range templatePlaceholderRe.FindAllStringIndex(first, -1) {
+		if loc[0] < last {
+			continue
+		}
+		literal := first[last:loc[0]]
+		if strings.HasSuffix(literal, "(") && strings.HasPrefix(first[loc[1]:], ")") {
+			b.WriteString(regexp.QuoteMeta(strings.TrimSuffix(literal, "(")) + `(?:\([^)]*\))?`)
+			last = loc[1] + 1
+			continue
+		}
+		b.WriteString(regexp.QuoteMeta(literal) + `.+?`)
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(first[last:]) + "$")
+	return regexp.MustCompile(b.String())
+}
+
+// validateCommitMessage returns a description of every commit rule broken by
+// the message. An empty result means the message is valid.
+func validateCommitMessage(message string) []string {
+	var violations []string
+	subject, _ := splitCommitSubject(strings.TrimSpace(message))
+	if subject == "" {
+		return append(violations, "commit message is empty")
+	}
+	if m := commitSubjectRe.FindStringSubmatch(subject); m != nil && applySubjectCase(m[2]) != m[2] {
+		violations = append(violations, fmt.Sprintf("subject description must be %s case", viper.GetString("COMMIT_SUBJECT_CASE")))
+	}
+	if tmpl := commitOutputTemplate(); tmpl != "" {
+		if !templateSubjectRe(tmpl).MatchString(subject) {
+			violations = append(violations, fmt.Sprintf("subject does not follow the template %q", strings.SplitN(tmpl, "\n", 2)[0]))
+		}
+		for _, placeholder := range templatePlaceholderRe.FindAllString(tmpl, -1) {
+			if strings.Contains(message, placeholder) {
+				violations = append(violations, fmt.Sprintf("template placeholder %s was not filled in", placeholder))
+			}
+		}
+	}
+	if allowed := allowedGitmoji(); allowed != nil {
+		if emoji := leadingEmoji(subject); emoji != "" && !allowed[normalizeEmoji(emoji)] {
+			violations = append(violations, fmt.Sprintf("gitmoji %s is not in ALLOWED_GITMOJI", emoji))
+		}
+	}
+	if mismatch := gitmojiTypeMismatch(subject); mismatch != "" {
+		violations = append(violations, mismatch)
+	}
+	if maxLines := viper.GetInt("COMMIT_MAX_LINES"); maxLines > 0 {
+		if lines := countMessageLines(message); lines > maxLines {
+			violations = append(violations, fmt.Sprintf("message has %d lines, at most %d allowed", lines, maxLines))
+		}
+	}
+	return violations
+}
+
+// countMessageLines counts the lines of the message that are not blank.
+func countMessageLines(message string) int {
+	count := 0
+	for _, line := range strings.Split(message, "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// gitmojiLineRe matches the "- <emoji> → <meaning>" entries of the gitmoji
+// list in the system instructions.
+var gitmojiLineRe = regexp.MustCompile(`(?m)^- (\S+) → (.+)$`)
+
+func normalizeEmoji(emoji string) string {
+	return strings.ReplaceAll(emoji, "\ufe0f", "")
+}
+
+// gitmojiTable maps every gitmoji listed in the system instructions to its
+// meaning.
+func gitmojiTable() map[string]string {
+	table := map[string]string{}
+	for _, m := range gitmojiLineRe.FindAllStringSubmatch(systemInstructionsContent, -1) {
+		table[normalizeEmoji(m[1])] = strings.TrimSpace(m[2])
+	}
+	return table
+}
+
+// allowedGitmoji returns the normalized ALLOWED_GITMOJI set, or nil when every
+// gitmoji is allowed.
+func allowedGitmoji() map[string]bool {
+	list := splitList(viper.GetString("ALLOWED_GITMOJI"))
+	if len(list) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool, len(list))
+	for _, emoji := range list {
+		allowed[normalizeEmoji(emoji)] = true
+	}
+	return allowed
+}
+
+// filterGitmoji drops the gitmoji entries of the system prompt that are not in
+// ALLOWED_GITMOJI and tells the model to pick from the remaining ones.
+func filterGitmoji(prompt string) string {
+	allowed := allowedGitmoji()
+	if allowed == nil {
+		return prompt
+	}
+	var lines []string
+	for _, line := range strings.Split(prompt, "\n") {
+		if m := gitmojiLineRe.FindStringSubmatch(line); m != nil && !allowed[normalizeEmoji(m[1])] {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return fmt.Sprintf("%s\n\nThis repository only allows these gitmoji: %s. Never use any other.", strings.TrimSpace(strings.Join(lines, "\n")), viper.GetString("ALLOWED_GITMOJI"))
+}
+
+// leadingEmoji returns the first token of the subject when it is an emoji.
+func leadingEmoji(message string) string {
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return ""
+	}
+	first := []rune(fields[0])[0]
+	if first <= unicode.MaxASCII || unicode.IsLetter(first) || unicode.IsDigit(first) {
+		return ""
+	}
+	return fields[0]
+}
+
+func showGitmojiSummary(message string) {
+	if !isatty.IsTerminal(os.Stderr.Fd()) {
+		return
+	}
+	emoji := leadingEmoji(message)
+	if emoji == "" {
+		return
+	}
+	if meaning, ok := gitmojiTable()[normalizeEmoji(emoji)]; ok {
+		logMessage(color.FgCyan, fmt.Sprintf("%s Gitmoji meaning: %s", emoji, meaning))
+		return
+	}
+	logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s is not a standard gitmoji", emoji))
+}
+
+// CommitOptions holds the commit command flags that change how the message is
+// generated.
+type CommitOptions struct {
+	Grep                 string
+	IncludeUnstaged      bool
+	Hint                 string
+	AllowConflictMarkers bool
+	// Only stages and commits just this pathspec instead of auto-staging.
+	Only []string
+	// Auto commits the AI message without the editor, failing instead of
+	// committing when it breaks a commit rule.
+	Auto bool
+	// Log is a build or CI log given to the model as context.
+	Log string
+}
+
+// readBuildLog reads the --from-log file, or stdin for "-", keeping the last
+// LOG_MAX_CHARS characters where the errors usually are.
+func readBuildLog(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+		// Give the editor and prompts the terminal back after reading the pipe
+		if tty, ttyErr := os.Open("/dev/tty"); ttyErr == nil {
+			os.Stdin = tty
+		}
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read log %s: %w", path, err)
+	}
+	log := strings.TrimSpace(string(data))
+	if limit := viper.GetInt("LOG_MAX_CHARS"); limit > 0 && len(log) > limit {
+		logDebug(fmt.Sprintf("Truncating the log from %d to its last %d characters", len(log), limit))
+		log = "[truncated]\n" + strings.ToValidUTF8(log[len(log)-limit:], "")
+	}
+	return log, nil
+}
+
+func (g *GitAI) Commit(extraArgs []string, opts CommitOptions) error {
+	logMessage(color.FgBlue, "📦 Starting commit process...")
+	hasChanges, err := g.gitOps.HasChanges()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
+		return err
+	}
+	amend := containsFlag(extraArgs, "--amend")
+	if !hasChanges && !amend {
+		logMessage(color.FgYellow, "ℹ️ Nothing to commit. Exiting.")
+		return nil
+	}
+	if len(opts.Only) > 0 {
+		if err := g.stageOnly(opts.Only); err != nil {
+			return err
+		}
+	} else if opts.Grep != "" {
+		if err := g.stageMatchingHunks(opts.Grep); err != nil {
+			logError(err.Error())
+			return err
+		}
+	} else if err := g.stageChangesIfNeeded(); err != nil {
+		return err
+	}
+	var amendContext []string
+	if amend {
+		if amendContext, err = g.amendContext(); err != nil {
+			logError(err.Error())
+			return err
+		}
+	}
+	stagedDiff, _ := g.gitOps.GetDiff(true)
+	if len(opts.Only) > 0 && strings.TrimSpace(stagedDiff) == "" {
+		logMessage(color.FgYellow, fmt.Sprintf("ℹ️ Nothing to commit in %s. Exiting.", strings.Join(opts.Only, " ")))
+		return nil
+	}
+	if done, err := g.commitStagedSpecialCases(stagedDiff, opts.AllowConflictMarkers, extraArgs); done {
+		return err
+	}
+	finalMessage, ok := g.generateDiffBasedMessage(true, append(g.commitContext(opts), amendContext...)...)
+	if !ok && opts.Auto {
+		return GitAIException{"No valid commit message was generated"}
+	}
+	if !ok {
+		logMessage(color.FgYellow, "🚫 Commit canceled by user.")
+		return nil
+	}
+	if opts.Auto {
+		if violations := validateCommitMessage(fixCommitMessage(finalMessage)); len(violations) > 0 {
+			logError(fmt.Sprintf("AI message failed validation, not committing:\n  - %s", strings.Join(violations, "\n  - ")))
+			return GitAIException{"Commit message failed validation"}
+		}
+	}
+	return g.commitWithMessage(finalMessage, extraArgs)
+}
+
+// commitStagedSpecialCases runs the checks every commit path applies to the
+// staged diff before asking the AI: conflict markers are refused unless
+// allowed, and submodule-only changes are committed with a message built from
+// the submodule versions. done reports that the commit was handled here.
+func (g *GitAI) commitStagedSpecialCases(stagedDiff string, allowConflictMarkers bool, extraArgs []string) (done bool, err error) {
+	if files := conflictMarkerFiles(stagedDiff); len(files) > 0 {
+		if !allowConflictMarkers {
+			logError(fmt.Sprintf("Conflict markers found in staged changes of: %s. Resolve them or pass --allow-conflict-markers.", strings.Join(files, ", ")))
+			return true, GitAIException{"Staged changes contain conflict markers"}
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Committing conflict markers in: %s", strings.Join(files, ", ")))
+	}
+	if changes := parseSubmoduleChanges(stagedDiff); len(changes) > 0 {
+		logMessage(color.FgCyan, "📦 Only submodule pointers changed. Building the message from their versions...")
+		finalMessage, ok := g.editContentInEditor(submoduleCommitMessage(changes))
+		if !ok {
+			logMessage(color.FgYellow, "🚫 Commit canceled by user.")
+			return true, nil
+		}
+		return true, g.commitWithMessage(finalMessage, extraArgs)
+	}
+	return false, nil
+}
+
+// amendContext compares the staged changes to the parent of HEAD, so the
+// message of an amended commit covers the whole amended change, and returns
+// the current message of HEAD as context.
+func (g *GitAI) amendContext() ([]string, error) {
+	if !g.gitOps.HasCommits() {
+		return nil, GitAIException{"Nothing to amend: the repository has no commits yet"}
+	}
+	base := "HEAD~1"
+	if !g.gitOps.RefExists(base) {
+		// The root commit is compared to the empty tree
+		emptyTree, err := runCmd("git", "hash-object", "-t", "tree", "/dev/null")
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the empty tree: %w", err)
+		}
+		base = emptyTree
+	}
+	logMessage(color.FgCyan, "✏️ Amending HEAD. Describing the whole amended commit...")
+	g.gitOps.DiffBase = base
+	original, err := g.gitOps.GetCommitMessage("HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the message of HEAD: %w", err)
+	}
+	return []string{fmt.Sprintf("EXISTING COMMIT MESSAGE (of the commit being amended, the diff above is the whole amended commit; keep what still applies):\n%s", original)}, nil
+}
+
+// commitContext returns the input data lines added below the staged diff when
+// generating a commit message.
+func (g *GitAI) commitContext(opts CommitOptions) []string {
+	var extraContext []string
+	if !g.gitOps.HasCommits() {
+		logMessage(color.FgMagenta, "🎉 No commits yet. Generating the initial commit message...")
+		extraContext = append(extraContext, "NOTE: This is the first commit of the repository. Use the 🎉 gitmoji.")
+	}
+	if nameStatus, err := g.gitOps.GetNameStatus(true); err == nil {
+		extraContext = append(extraContext, summarizeNameStatus(nameStatus)...)
+	}
+	files, _ := g.gitOps.GetChangedFiles(true)
+	if modules := affectedModules(files); len(modules) > 0 {
+		scope := strings.Join(modules, ",")
+		logDebug(fmt.Sprintf("Affected modules: %s", scope))
+		extraContext = append(extraContext, fmt.Sprintf("AFFECTED MODULES: %s (use them as the commit scope, e.g. \"type(%s): description\")", scope, scope))
+	} else if viper.GetBool("COMMIT_SCOPE_FROM_PATH") {
+		if scope := scopeFromPaths(files); scope != "" {
+			logDebug(fmt.Sprintf("Derived commit scope %q from changed paths", scope))
+			extraContext = append(extraContext, fmt.Sprintf("SCOPE: %s (use it as the commit scope, e.g. \"type(%s): description\")", scope, scope))
+		}
+	}
+	if opts.IncludeUnstaged {
+		if unstaged, _ := g.gitOps.GetDiff(false); strings.TrimSpace(unstaged) != "" {
+			logDebug("Including unstaged changes as context")
+			extraContext = append(extraContext, fmt.Sprintf("UNSTAGED GIT DIFFERENCE (context only, NOT part of this commit):\n%s", normalizeDiff(unstaged)))
+		}
+	}
+	if viper.GetBool("INFER_ISSUE") {
+		if issues := g.openIssues(); len(issues) > 0 {
+			extraContext = append(extraContext, fmt.Sprintf("OPEN ISSUES:\n%s\nOnly when the change clearly addresses one of these issues, end the subject with \" (#<number>)\" of that issue. "+
+				"When in doubt, reference none.", strings.Join(issues, "\n")))
+		}
+	}
+	if opts.Log != "" {
+		extraContext = append(extraContext, fmt.Sprintf("BUILD LOG (context only, NOT part of this commit; the change fixes the failure it shows, "+
+			"so say briefly what was broken, e.g. \"(fixes CI panic)\"):\n%s", opts.Log))
+	}
+	if hint := strings.TrimSpace(opts.Hint); hint != "" {
+		extraContext = append(extraContext, fmt.Sprintf("IMPORTANT: The primary intent of this change is: %s. The message must describe this intent.", hint))
+	}
+	return extraContext
+}
+
+// inferIssueLimit is how many open issues are offered to the model.
+const inferIssueLimit = 30
+
+// openIssues lists the open issues as "#<number> <title>" lines for the model
+// to pick from, unless the branch name already carries a ticket.
+func (g *GitAI) openIssues() []string {
+	branch, _ := g.gitOps.GetCurrentBranch()
+	if g.detectTicketNumber(branch) != "NO-TICKET" || !hasGH() {
+		return nil
+	}
+	logDebug("Listing open issues to infer the related one")
+	out, err := runCmd("gh", "issue", "list", "--state", "open", "--limit", strconv.Itoa(inferIssueLimit), "--json", "number,title")
+	if err != nil {
+		logDebug(fmt.Sprintf("Failed to list open issues: %s", out))
+		return nil
+	}
+	var issues []struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+	}
+	if err := json.Unmarshal([]byte(out), &issues); err != nil {
+		logDebug(fmt.Sprintf("Failed to parse open issues: %s", err.Error()))
+		return nil
+	}
+	var lines []string
+	for _, issue := range issues {
+		lines = append(lines, fmt.Sprintf("#%d %s", issue.Number, issue.Title))
+	}
+	return lines
+}
+
+// Preview generates the commit message for the staged changes without the
+// editor or committing, for editor and IDE integrations. When onToken is set
+// the message is streamed to it.
+func (g *GitAI) Preview(onToken func(string)) (string, error) {
+	diff, err := g.gitOps.GetDiff(true)
+	if err != nil {
+		return "", fmt.Errorf("failed to get staged diff: %w", err)
+	}
+	if strings.TrimSpace(diff) == "" {
+		return "", GitAIException{"No staged changes"}
+	}
+	userData := commitInputData(diff, g.commitContext(CommitOptions{}))
+	var message string
+	if onToken != nil {
+		message, err = g.StreamMessage(taskCommit, g.systemInstructions(), commitInstructions(), userData, onToken)
+	} else {
+		message, err = g.GenerateMessage(taskCommit, g.systemInstructions(), commitInstructions(), userData)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fixCommitMessage(message), nil
+}
+
+// conflictMarkerFiles returns the files of the diff whose added lines contain
+// <<<<<<< or >>>>>>> conflict markers.
+func conflictMarkerFiles(diff string) []string {
+	var files []string
+	current, flagged := "", false
+	for _, line := range strings.Split(diff, "\n") {
+		if m := diffFileRe.FindStringSubmatch(line); m != nil {
+			current, flagged = m[1], false
+			continue
+		}
+		if flagged || current == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "+<<<<<<<") || strings.HasPrefix(line, "+>>>>>>>") {
+			files = append(files, current)
+			flagged = true
+		}
+	}
+	return files
+}
+
+// summarizeNameStatus turns git diff --name-status output into input data
+// lines counting the kinds of file changes, so deletions are not overlooked.
+func summarizeNameStatus(nameStatus string) []string {
+	counts := map[byte]int{}
+	var deleted []string
+	for _, line := range strings.Split(nameStatus, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || fields[0] == "" {
+			continue
+		}
+		counts[fields[0][0]]++
+		if fields[0][0] == 'D' {
+			deleted = append(deleted, fields[1])
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("FILE CHANGES: %d added, %d modified, %d deleted, %d renamed",
+		counts['A'], counts['M'], counts['D'], counts['R'])}
+	if len(deleted) > 0 {
+		lines = append(lines, "DELETED FILES:\n"+strings.Join(deleted, "\n"))
+	}
+	if counts['D'] > 0 && counts['D'] >= counts['A']+counts['M'] {
+		lines = append(lines, "NOTE: This change mainly removes files. Prefer the 🔥 or 🗑️ gitmoji.")
+	}
+	return lines
+}
+
+// affectedModules maps the changed files to module names with MODULE_MAP
+// ("services/billing/=billing,pkg/auth/=auth"), in order of first appearance.
+// The longest matching prefix wins.
+func affectedModules(files []string) []string {
+	prefixes := map[string]string{}
+	for _, entry := range splitList(viper.GetString("MODULE_MAP")) {
+		if prefix, module, ok := strings.Cut(entry, "="); ok {
+			prefixes[strings.TrimSpace(prefix)] = strings.TrimSpace(module)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var modules []string
+	seen := map[string]bool{}
+	for _, file := range files {
+		best, module := 0, ""
+		for prefix, name := range prefixes {
+			if strings.HasPrefix(file, prefix) && len(prefix) > best {
+				best, module = len(prefix), name
+			}
+		}
+		if module != "" && !seen[module] {
+			seen[module] = true
+			modules = append(modules, module)
+		}
+	}
+	return modules
+}
+
+// scopeFromPaths returns the top-level directory shared by most of the changed
+// files, or an empty string when no directory covers the majority of them.
+func scopeFromPaths(files []string) string {
+	counts := map[string]int{}
+	best := ""
+	for _, file := range files {
+		dir, _, found := strings.Cut(file, "/")
+		if !found {
+			continue
+		}
+		counts[dir]++
+		if counts[dir] > counts[best] || (counts[dir] == counts[best] && dir < best) {
+			best = dir
+		}
+	}
+	if best == "" || counts[best]*2 <= len(files) {
+		return ""
+	}
+	return best
+}
+
+// submoduleChange is a submodule pointer moved from one commit to another.
+// From is empty for a newly added submodule.
+type submoduleChange struct {
+	path string
+	from string
+	to   string
+}
+
+// parseSubmoduleChanges returns the submodule pointer updates of the diff, or
+// nil when the diff contains anything other than submodule updates.
+func parseSubmoduleChanges(diff string) []submoduleChange {
+	var changes []submoduleChange
+	for _, section := range strings.Split(diff, "diff --git ")[1:] {
+		m := diffFileRe.FindStringSubmatch("diff --git " + strings.SplitN(section, "\n", 2)[0])
+		if m == nil {
+			return nil
+		}
+		change := submoduleChange{path: m[1]}
+		for _, line := range strings.Split(section, "\n")[1:] {
+			switch {
+			case strings.HasPrefix(line, "-Subproject commit "):
+				change.from = strings.TrimPrefix(line, "-Subproject commit ")
+			case strings.HasPrefix(line, "+Subproject commit "):
+				change.to = strings.TrimPrefix(line, "+Subproject commit ")
+			case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+			case strings.HasPrefix(line, "-"), strings.HasPrefix(line, "+"):
+				return nil
+			}
+		}
+		if change.to == "" {
+			return nil
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// submoduleVersion describes a submodule commit by its tag when one exists,
+// falling back to the abbreviated hash.
+func submoduleVersion(path, commit string) string {
+	if out, err := runCmd("git", "-C", path, "describe", "--tags", "--exact-match", commit); err == nil {
+		return out
+	}
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+func submoduleCommitMessage(changes []submoduleChange) string {
+	var paths, body []string
+	for _, change := range changes {
+		paths = append(paths, change.path)
+		to := submoduleVersion(change.path, change.to)
+		if change.from == "" {
+			body = append(body, fmt.Sprintf("- add %s at %s", change.path, to))
+			continue
+		}
+		body = append(body, fmt.Sprintf("- %s: %s → %s", change.path, submoduleVersion(change.path, change.from), to))
+	}
+	subject := fmt.Sprintf("⬆️ chore: bump %s submodule", paths[0])
+	if len(changes) == 1 {
+		subject += " to " + submoduleVersion(changes[0].path, changes[0].to)
+	} else {
+		subject = fmt.Sprintf("⬆️ chore: bump %s submodules", strings.Join(paths, ", "))
+	}
+	return subject + "\n\n" + strings.Join(body, "\n")
+}
+
+// diffFile is the header of one file in a unified diff and its hunks.
+type diffFile struct {
+	header string
+	hunks  []string
+}
+
+func parseDiffHunks(diff string) []diffFile {
+	var files []diffFile
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			files = append(files, diffFile{header: line + "\n"})
+		case len(files) == 0:
+		case strings.HasPrefix(line, "@@"):
+			last := &files[len(files)-1]
+			last.hunks = append(last.hunks, line+"\n")
+		default:
+			last := &files[len(files)-1]
+			if len(last.hunks) == 0 {
+				last.header += line + "\n"
+			} else {
+				last.hunks[len(last.hunks)-1] += line + "\n"
+			}
+		}
+	}
+	return files
+}
+
+// selectHunks builds a patch of the hunks with an added or removed line
+// matching re and returns it with the number of selected hunks.
+func selectHunks(files []diffFile, re *regexp.Regexp) (string, int) {
+	var patch strings.Builder
+	count := 0
+	for _, file := range files {
+		var selected []string
+		for _, hunk := range file.hunks {
+			for _, line := range strings.Split(hunk, "\n")[1:] {
+				if (strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")) && re.MatchString(line[1:]) {
+					selected = append(selected, hunk)
+					break
+				}
+			}
+		}
+		if len(selected) == 0 {
+			continue
+		}
+		count += len(selected)
+		patch.WriteString(file.header)
+		patch.WriteString(strings.Join(selected, ""))
+	}
+	return patch.String(), count
+}
+
+// stageMatchingHunks stages only the unstaged hunks whose changed lines
+// match the pattern.
+func (g *GitAI) stageMatchingHunks(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return GitAIException{fmt.Sprintf("Invalid --grep pattern: %s", err.Error())}
+	}
+	diff, err := g.gitOps.GetDiff(false)
+	if err != nil {
+		return fmt.Errorf("failed to get unstaged diff: %w", err)
+	}
+	patch, count := selectHunks(parseDiffHunks(diff), re)
+	if count == 0 {
+		return GitAIException{fmt.Sprintf("No unstaged hunks match %q", pattern)}
+	}
+	logMessage(color.FgCyan, fmt.Sprintf("🔎 Staging %d hunk(s) matching %q...", count, pattern))
+	return g.gitOps.ApplyCached(patch)
+}
+
+// commitWithMessage applies the commit rules to the reviewed message and
+// creates the commit.
+func (g *GitAI) commitWithMessage(finalMessage string, extraArgs []string) error {
+	finalMessage = fixCommitMessage(finalMessage)
+	for _, violation := range validateCommitMessage(finalMessage) {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s", violation))
+	}
+	showGitmojiSummary(finalMessage)
+	if viper.GetBool("COMMIT_SIGNOFF") {
+		signed, err := g.signOff(finalMessage)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to add Signed-off-by trailer: %s", err.Error()))
+			return err
+		}
+		finalMessage = signed
+	}
+	logDebug("Committing changes with final message")
+	if !viper.GetBool("COMMIT_SIGN") || containsFlag(extraArgs, "--no-gpg-sign") {
+		return g.gitOps.Commit(finalMessage, keepAuthorDate(extraArgs))
+	}
+	if err := g.gitOps.Commit(finalMessage, keepAuthorDate(withSigning(extraArgs))); err != nil {
+		return err
+	}
+	// The commit exists at this point, so a failed check only warns and lets
+	// push, ship and release carry on
+	if err := g.gitOps.VerifyCommit("HEAD"); err != nil {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ The commit was created, but its signature could not be verified. Check your signing key setup.\n%s", err.Error()))
+	}
+	return nil
+}
+
+// withSigning adds -S to the commit flags unless signing is already requested.
+func withSigning(flags []string) []string {
+	if containsFlag(flags, "-S") || containsFlag(flags, "--gpg-sign") {
+		return flags
+	}
+	return append(flags, "-S")
+}
+
+// keepAuthorDate pins the author date of an amended commit to the original one
+// when AMEND_KEEP_DATE is set and no --date was passed explicitly.
+func keepAuthorDate(flags []string) []string {
+	if !viper.GetBool("AMEND_KEEP_DATE") {
+		return flags
+	}
+	amend := false
+	for _, flag := range flags {
+		if flag == "--date" || strings.HasPrefix(flag, "--date=") {
+			return flags
+		}
+		amend = amend || flag == "--amend"
+	}
+	if !amend {
+		return flags
+	}
+	date, err := runCmd("git", "log", "-1", "--pretty=%aI")
+	if err != nil {
+		logMessage(color.FgYellow, "⚠️ Could not read the original author date. Amending with git's default.")
+		return flags
+	}
+	logDebug(fmt.Sprintf("Keeping original author date %s", date))
+	return append(flags, "--date="+date)
+}
+
+// signOff appends a Developer Certificate of Origin trailer for the configured
+// git identity.
+func (g *GitAI) signOff(message string) (string, error) {
+	name, err := runCmd("git", "config", "user.name")
+	if err != nil {
+		return "", fmt.Errorf("git user.name is not configured")
+	}
+	email, err := runCmd("git", "config", "user.email")
+	if err != nil {
+		return "", fmt.Errorf("git user.email is not configured")
+	}
+	return g.gitOps.AddTrailer(message, fmt.Sprintf("Signed-off-by: %s <%s>", name, email))
+}
+
+// CommitPatch generates a commit message for a unified diff stored in a file.
+// Without apply the message is only printed; with apply the patch is applied
+// to the index and working tree and committed.
+func (g *GitAI) CommitPatch(path string, apply bool, extraArgs []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to read patch file: %s", err.Error()))
+		return err
+	}
+	if out, err := runCmd("git", "apply", "--stat", path); err != nil {
+		logError(fmt.Sprintf("Invalid patch file %s\nOutput: %s", path, out))
+		return GitAIException{"Cannot parse patch file " + path}
+	}
+	if apply {
+		if out, err := runCmd("git", "apply", "--check", "--index", path); err != nil {
+			logError(fmt.Sprintf("Patch does not apply cleanly\nOutput: %s", out))
+			return GitAIException{"Cannot apply patch file " + path}
+		}
+	}
+	userData := buildInputData("", "", "", "", string(data))
+	aiOutput, err := g.GenerateMessage(taskCommit, g.systemInstructions(), commitInstructions(), userData)
+	if err != nil {
+		logError(fmt.Sprintf("OpenAI error: %s", err.Error()))
+		return err
+	}
+	if !apply {
+		fmt.Println(aiOutput)
+		return nil
+	}
+	finalMessage, saved := g.reviewAIOutput(aiOutput)
+	if !saved {
+		logMessage(color.FgYellow, "🚫 Commit canceled by user.")
+		return nil
+	}
+	logMessage(color.FgBlue, fmt.Sprintf("🩹 Applying %s...", path))
+	if out, err := runCmd("git", "apply", "--index", path); err != nil {
+		logError(fmt.Sprintf("Failed to apply patch: %s\nOutput: %s", err.Error(), out))
+		return fmt.Errorf("failed to apply patch: %w", err)
+	}
+	return g.commitWithMessage(finalMessage, extraArgs)
+}
+
+// Amend regenerates the message of the last commit from its diff and the
+// current message, leaving its contents and any staged changes alone. A
+// pushed commit is only rewritten with force.
+func (g *GitAI) Amend(force bool, extraArgs []string) error {
+	if !g.gitOps.HasCommits() {
+		logError("Nothing to amend: the repository has no commits yet")
+		return GitAIException{"No commits to amend"}
+	}
+	if remote := g.gitOps.PushedTo("HEAD"); remote != "" {
+		if !force {
+			logError(fmt.Sprintf("HEAD is already pushed (%s). Pass --force to rewrite it anyway.", remote))
+			return GitAIException{"HEAD is already pushed"}
+		}
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Rewriting HEAD although it is pushed (%s). You will need to force push.", remote))
+	}
+	diff, err := runCmd("git", "show", "--format=", "--patch", "HEAD")
+	if err != nil {
+		logError(fmt.Sprintf("Failed to get the diff of HEAD: %s", diff))
+		return err
+	}
+	original, err := g.gitOps.GetCommitMessage("HEAD")
+	if err != nil {
+		logError(fmt.Sprintf("Failed to get the last commit message: %s", original))
+		return err
+	}
+	logMessage(color.FgCyan, "✏️ Rewriting the message of the last commit...")
+	userData := buildInputData("", "", "", "", diff) +
+		fmt.Sprintf("EXISTING COMMIT MESSAGE (improve it so it describes the changes above):\n%s\n", original)
+	aiOutput, err := g.GenerateMessage(taskCommit, g.systemInstructions(), commitInstructions(), userData)
+	if err != nil {
+		logError(fmt.Sprintf("OpenAI error: %s", err.Error()))
+		return err
+	}
+	finalMessage, saved := g.reviewAIOutput(aiOutput)
+	if !saved {
+		logMessage(color.FgYellow, "🚫 Amend canceled by user.")
+		return nil
+	}
+	// --only keeps staged changes out of the amended commit
+	return g.commitWithMessage(finalMessage, append(extraArgs, "--amend", "--only"))
+}
+
+// RewordBranch regenerates the message of every commit of the branch since
+// it left its base branch from the commit's own diff, previews them and
+// rewrites the branch with git rebase. The commit contents stay as they are.
+// Commits that are already pushed anywhere are refused.
+func (g *GitAI) RewordBranch() error {
+	hasChanges, err := g.gitOps.HasChanges()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
+		return err
+	}
+	if hasChanges {
+		logError("The working tree has changes. Commit or stash them before rewording the branch.")
+		return GitAIException{"Working tree is not clean"}
+	}
+	branch, err := g.gitOps.GetCurrentBranch()
+	if err != nil || branch == "HEAD" {
+		logError("Not on a branch. Check out the branch to reword first.")
+		return GitAIException{"Not on a branch"}
+	}
+	base, _ := baseBranch(branch)
+	if !g.gitOps.RefExists("origin/" + base) {
+		logError(fmt.Sprintf("origin/%s does not exist, so the commits of %s cannot be told apart. Fetch it or set MAIN_BRANCH.", base, branch))
+		return GitAIException{"Base branch not found"}
+	}
+	upstream, err := runCmd("git", "merge-base", "origin/"+base, branch)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to find where %s left origin/%s: %s", branch, base, upstream))
+		return err
+	}
+	rangeSpec := upstream + ".." + branch
+	if merges, _ := runCmd("git", "rev-list", "--merges", rangeSpec); merges != "" {
+		logError(fmt.Sprintf("%s contains merge commits, which a reword rebase would flatten. Refusing to rewrite it.", branch))
+		return GitAIException{"Branch contains merge commits"}
+	}
+	out, err := runCmd("git", "rev-list", "--reverse", rangeSpec)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to list the commits of %s: %s", branch, out))
+		return err
+	}
+	if out == "" {
+		logMessage(color.FgYellow, fmt.Sprintf("ℹ️ %s has no commits of its own. Exiting.", branch))
+		return nil
+	}
+	shas := strings.Split(out, "\n")
+	for _, sha := range shas {
+		if remote := g.gitOps.PushedTo(sha); remote != "" {
+			short, _ := runCmd("git", "rev-parse", "--short", sha)
+			logError(fmt.Sprintf("Commit %s is already pushed (%s). Refusing to rewrite shared history.", short, remote))
+			return GitAIException{"Commit " + short + " is already pushed"}
+		}
+	}
+
+	logMessage(color.FgCyan, fmt.Sprintf("✏️ Regenerating the messages of %d commits of %s...", len(shas), branch))
+	messages := make([]string, len(shas))
+	for i, sha := range shas {
+		diff, err := runCmd("git", "show", "--format=", "--patch", sha)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to get the diff of %s: %s", sha, diff))
+			return err
+		}
+		original, _ := g.gitOps.GetCommitMessage(sha)
+		userData := buildInputData("", "", "", "", diff) +
+			fmt.Sprintf("EXISTING COMMIT MESSAGE (improve it so it describes the changes above):\n%s\n", original)
+		aiOutput, err := g.GenerateMessage(taskCommit, g.systemInstructions(), commitInstructions(), userData)
+		if err != nil {
+			logError(fmt.Sprintf("OpenAI error: %s", err.Error()))
+			return err
+		}
+		messages[i] = fixCommitMessage(stripComments(aiOutput))
+	}
+
+	for i, sha := range shas {
+		subject, _ := runCmd("git", "log", "-1", "--format=%h %s", sha)
+		fmt.Fprintf(os.Stderr, "\n%s\n", color.New(color.FgYellow).Sprintf("- %s", subject))
+		for _, line := range strings.Split(messages[i], "\n") {
+			fmt.Fprintf(os.Stderr, "  %s\n", line)
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+	if !confirm(fmt.Sprintf("Rewrite %d commits of %s with these messages?", len(shas), branch)) {
+		logMessage(color.FgYellow, "🚫 Reword canceled by user.")
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "gai-reword-*")
+	if err != nil {
+		logError(fmt.Sprintf("Failed to create a temporary directory: %s", err.Error()))
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// Each pick is followed by an exec that amends its message, so the
+	// sequence editor only has to replace the todo list
+	var todo strings.Builder
+	for i, sha := range shas {
+		messageFile := filepath.Join(dir, sha+".txt")
+		if err := os.WriteFile(messageFile, []byte(messages[i]+"\n"), 0o600); err != nil {
+			logError(fmt.Sprintf("Failed to write the message of %s: %s", sha, err.Error()))
+			return err
+		}
+		todo.WriteString(fmt.Sprintf("pick %s\nexec git commit --amend --allow-empty --no-verify --quiet -F %s\n", sha, shellQuote(messageFile)))
+	}
+	todoFile := filepath.Join(dir, "todo")
+	if err := os.WriteFile(todoFile, []byte(todo.String()), 0o600); err != nil {
+		logError(fmt.Sprintf("Failed to write the rebase todo list: %s", err.Error()))
+		return err
+	}
+	args := []string{"rebase", "--interactive", upstream}
+	logDebug(fmt.Sprintf("Rewriting %s (git %s)", branch, strings.Join(args, " ")))
+	cmd := exec.Command(binaryPath("git"), args...)
+	cmd.Env = append(os.Environ(), "GIT_SEQUENCE_EDITOR=cp "+shellQuote(todoFile))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logError(fmt.Sprintf("Rebase failed: %s\nRun 'git rebase --abort' to restore the branch.", strings.TrimSpace(string(out))))
+		return err
+	}
+	logMessage(color.FgGreen, fmt.Sprintf("📝 Reworded %d commits of %s.", len(shas), branch))
+	return nil
+}
+
+// shellQuote quotes the argument for sh.
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// Fixup folds the current changes into the commit at ref with a message
+// regenerated from the commit diff and the new changes. HEAD is amended
+// directly; an older commit gets an "amend!" commit for git rebase
+// --autosquash. Commits that are already on a remote are refused.
+func (g *GitAI) Fixup(ref string, extraArgs []string) error {
+	sha, err := runCmd("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		logError(fmt.Sprintf("Unknown commit %s", ref))
+		return GitAIException{"Unknown commit " + ref}
+	}
+	if remote := g.gitOps.PushedTo(sha); remote != "" {
+		logError(fmt.Sprintf("Commit %s is already pushed (%s). Refusing to rewrite it.", ref, remote))
+		return GitAIException{"Commit " + ref + " is already pushed"}
+	}
+	hasChanges, err := g.gitOps.HasChanges()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
+		return err
+	}
+	if !hasChanges {
+		logMessage(color.FgYellow, "ℹ️ Nothing to fold into the commit. Exiting.")
+		return nil
+	}
+	if err := g.stageChangesIfNeeded(); err != nil {
+		return err
+	}
+
+	commitDiff, err := runCmd("git", "show", "--format=", "--patch", sha)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to get the diff of %s: %s", ref, commitDiff))
+		return err
+	}
+	stagedDiff, _ := g.gitOps.GetDiff(true)
+	original, _ := g.gitOps.GetCommitMessage(sha)
+	userData := buildInputData("", "", "", "", commitDiff+"\n"+stagedDiff) +
+		fmt.Sprintf("EXISTING COMMIT MESSAGE (update it so it covers all the changes above):\n%s\n", original)
+	aiOutput, err := g.GenerateMessage(taskCommit, g.systemInstructions(), commitInstructions(), userData)
+	if err != nil {
+		logError(fmt.Sprintf("OpenAI error: %s", err.Error()))
+		return err
+	}
+	finalMessage, saved := g.reviewAIOutput(aiOutput)
+	if !saved {
+		logMessage(color.FgYellow, "🚫 Fixup canceled by user.")
+		return nil
+	}
+
+	head, _ := runCmd("git", "rev-parse", "HEAD")
+	if sha == head {
+		return g.commitWithMessage(finalMessage, append([]string{"--amend"}, extraArgs...))
+	}
+	subject, _ := splitCommitSubject(original)
+	amendMessage := fmt.Sprintf("amend! %s\n\n%s", subject, fixCommitMessage(finalMessage))
+	if err := g.gitOps.Commit(amendMessage, extraArgs); err != nil {
+		return err
+	}
+	short, _ := runCmd("git", "rev-parse", "--short", sha)
+	logMessage(color.FgCyan, fmt.Sprintf("🔁 Run 'git rebase -i --autosquash %s^' to fold it into %s.", short, short))
+	return nil
 }
 
 func (g *GitAI) stageChangesIfNeeded() error {
 	diff, _ := g.gitOps.GetDiff(true)
 	if strings.TrimSpace(diff) != "" {
 		logMessage(color.FgBlue, "📂 Changes already staged.")
+		return g.handleMixedChanges()
+	}
+	logMessage(color.FgCyan, "🗂️ No changes staged. Automatically staging all...")
+	if err := g.gitOps.StageAllChanges(); err != nil {
+		logError(fmt.Sprintf("Failed to stage changes: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// stageOnly stages the pathspec and scopes the diffs and the commit to it.
+// Changes outside the pathspec are never auto-staged, and changes already
+// staged there stay staged but are left out of the commit.
+func (g *GitAI) stageOnly(pathspec []string) error {
+	logMessage(color.FgCyan, fmt.Sprintf("🗂️ Staging and committing only %s...", strings.Join(pathspec, " ")))
+	if err := g.gitOps.StagePaths(pathspec); err != nil {
+		logError(fmt.Sprintf("Failed to stage %s: %s", strings.Join(pathspec, " "), err.Error()))
+		return err
+	}
+	g.gitOps.Pathspec = pathspec
+	if others, _ := (&GitOperations{}).GetChangedFiles(true); len(others) > 0 {
+		scoped, _ := g.gitOps.GetChangedFiles(true)
+		if len(others) > len(scoped) {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ %d staged file(s) outside %s stay staged and are not part of this commit.", len(others)-len(scoped), strings.Join(pathspec, " ")))
+		}
+	}
+	return nil
+}
+
+// handleMixedChanges applies MIXED_CHANGES when unstaged changes exist next to
+// staged ones: "warn" reports them, "stage-all" stages them and "staged-only"
+// leaves them out silently.
+func (g *GitAI) handleMixedChanges() error {
+	mode := viper.GetString("MIXED_CHANGES")
+	if mode == "staged-only" {
+		return nil
+	}
+	unstaged, _ := g.gitOps.GetChangedFiles(false)
+	if len(unstaged) == 0 {
+		return nil
+	}
+	if mode == "stage-all" {
+		logMessage(color.FgCyan, fmt.Sprintf("🗂️ Staging %d file(s) with unstaged changes as well...", len(unstaged)))
+		if err := g.gitOps.StageAllChanges(); err != nil {
+			logError(fmt.Sprintf("Failed to stage changes: %s", err.Error()))
+			return err
+		}
+		return nil
+	}
+	logMessage(color.FgYellow, fmt.Sprintf("⚠️ %d file(s) with unstaged changes are not part of this commit: %s", len(unstaged), strings.Join(unstaged, ", ")))
+	return nil
+}
+
+// regenerateState counts the regenerations of one staged diff, kept in the
+// git directory so every run of gai regenerate varies the output further.
+type regenerateState struct {
+	DiffHash string `json:"diffHash"`
+	Count    int    `json:"count"`
+}
+
+// bumpTemperature raises the commit temperature by REGENERATE_TEMPERATURE_STEP
+// for every earlier regeneration of the same staged diff, capped at 2.
+func bumpTemperature(diff string) {
+	step := viper.GetFloat64("REGENERATE_TEMPERATURE_STEP")
+	path, err := runCmd("git", "rev-parse", "--git-path", "gai-regenerate.json")
+	if step <= 0 || err != nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(diff))
+	hash := hex.EncodeToString(sum[:])
+	var state regenerateState
+	if data, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(data, &state)
+	}
+	if state.DiffHash != hash {
+		state = regenerateState{DiffHash: hash}
+	}
+	temperature := math.Min(float64(temperatureFor(taskCommit))+step*float64(state.Count), 2)
+	if state.Count > 0 {
+		logMessage(color.FgCyan, fmt.Sprintf("🎲 Regeneration %d, using temperature %.2f", state.Count+1, temperature))
+		viper.Set("TEMPERATURE_"+taskCommit, temperature)
+	}
+	state.Count++
+	if data, err := json.Marshal(state); err == nil {
+		_ = os.WriteFile(path, data, 0o644)
+	}
+}
+
+// Regenerate generates a new message for the already staged changes and
+// commits it, without staging anything.
+func (g *GitAI) Regenerate(extraArgs []string, allowConflictMarkers bool) error {
+	diff, err := g.gitOps.GetDiff(true)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to get staged diff: %s", err.Error()))
+		return err
+	}
+	if strings.TrimSpace(diff) == "" {
+		logMessage(color.FgYellow, "ℹ️ Nothing to commit. Exiting.")
+		return nil
+	}
+	if done, err := g.commitStagedSpecialCases(diff, allowConflictMarkers, extraArgs); done {
+		return err
+	}
+	bumpTemperature(diff)
+	finalMessage, ok := g.generateDiffBasedMessage(true, g.commitContext(CommitOptions{})...)
+	if !ok {
+		logMessage(color.FgYellow, "🚫 Commit canceled by user.")
+		return nil
+	}
+	return g.commitWithMessage(finalMessage, extraArgs)
+}
+
+func (g *GitAI) Stash(extraArgs []string) error {
+	logMessage(color.FgGreen, "💾 Stashing changes with AI-generated message...")
+	message, ok := g.generateDiffBasedMessage(false)
+	if !ok {
+		logMessage(color.FgYellow, "🚫 Stash canceled by user.")
+		return nil
+	}
+	stashArgs := append([]string{"stash", "push", "-m", message}, extraArgs...)
+	logDebug(fmt.Sprintf("Executing command: git %s", strings.Join(stashArgs, " ")))
+	out, err := runCmd("git", stashArgs...)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to stash changes: %s\nOutput: %s", err.Error(), out))
+		return fmt.Errorf("failed to stash changes: %w", err)
+	}
+	logMessage(color.FgGreen, "🗄️ Changes stashed successfully!")
+	return nil
+}
+
+// PushOptions holds the push command flags that change how pull requests are
+// handled.
+type PushOptions struct {
+	SkipPR          bool
+	InteractiveMeta bool
+	Render          bool
+	// RegenerateSection rewrites one picked section of an existing PR body
+	// and keeps the rest of it as it is.
+	RegenerateSection bool
+}
+
+// PushResult describes what a push did so the command layer can report it.
+type PushResult struct {
+	Branch   string
+	Pushed   bool
+	PRNumber string
+	PRURL    string
+	Created  bool
+}
+
+// PushGit is the git side of Push. GitOperations implements it.
+type PushGit interface {
+	GetCurrentBranch() (string, error)
+	HasCommitsToPush(mainBranch, currentBranch string) (bool, error)
+	IsPushed() bool
+	RemoteBranchExists(remote, branch string) bool
+	Fetch(remote, branch string) error
+	Push(currentBranch, remote string, flags []string) error
+	RemoteURL(remote string) (string, error)
+	RefExists(ref string) bool
+	AheadBehind(base, branch string) (ahead, behind int, err error)
+	CountMerges(revRange string) (int, error)
+	GetCommitMessages(mBranch, currentBranch string) (string, error)
+	GetDiff(staged bool) (string, error)
+}
+
+// Forge looks up the pull requests of the hosting service for Push.
+type Forge interface {
+	// Available reports whether the forge can be reached, e.g. gh is installed.
+	Available() bool
+	// FindPR returns the number of the open pull request of the branch, or an
+	// empty string when there is none.
+	FindPR(branch string) (string, error)
+	PRURL(number string) string
+}
+
+// ghForge is the GitHub Forge backed by the gh CLI.
+type ghForge struct{}
+
+func (ghForge) Available() bool { return hasGH() }
+
+func (ghForge) FindPR(branch string) (string, error) {
+	logDebug(fmt.Sprintf("Listing PRs for branch %s", branch))
+	out, err := runCmd("gh", "pr", "list", "--head", branch, "--json", "number")
+	if err != nil {
+		return "", fmt.Errorf("failed to check existing PRs: %w\n%s", err, out)
+	}
+	var prList []struct {
+		Number int `json:"number"`
+	}
+	if e := json.Unmarshal([]byte(out), &prList); e != nil {
+		return "", fmt.Errorf("failed to parse PR list JSON: %w", e)
+	}
+	if len(prList) > 0 {
+		return fmt.Sprintf("%d", prList[0].Number), nil
+	}
+	return "", nil
+}
+
+func (ghForge) PRURL(number string) string {
+	out, err := runCmd("gh", "pr", "view", number, "--json", "url", "--jq", ".url")
+	if err != nil {
+		logDebug(fmt.Sprintf("Failed to get URL of PR #%s: %s", number, out))
+		return ""
+	}
+	return out
+}
+
+func (g *GitAI) Push(extraArgs []string, opts PushOptions) (PushResult, error) {
+	var result PushResult
+	logMessage(color.FgBlue, "🔄 Preparing to push changes...")
+	currentBranch, err := g.pushGit.GetCurrentBranch()
+	if err != nil {
+		logError(fmt.Sprintf("Could not get current branch: %s", err.Error()))
+		return result, err
+	}
+	result.Branch = currentBranch
+	logDebug(fmt.Sprintf("Current branch: %s", currentBranch))
+	mainBranch, _ := baseBranch(currentBranch)
+	hasCommits, err := g.pushGit.HasCommitsToPush(mainBranch, currentBranch)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for commits to push: %s", err.Error()))
+		return result, err
+	}
+	if !hasCommits {
+		return result, nil
+	}
+	if g.pushGit.IsPushed() {
+		logMessage(color.FgCyan, "⏩ Branch is already up to date with its upstream. Resuming at the pull request step...")
+	} else {
+		logMessage(color.FgBlue, "⬆️ Pushing changes to remote...")
+		if err := g.pushChanges(mainBranch, extraArgs); err != nil {
+			logError(err.Error())
+			return result, err
+		}
+	}
+	result.Pushed = true
+	if opts.SkipPR {
+		return result, nil
+	}
+	g.warnBranchHygiene(mainBranch, currentBranch)
+	if !g.forge.Available() {
+		webURL, err := g.pushGit.RemoteURL("origin")
+		if err == nil {
+			webURL, err = webURLFromRemote(webURL)
+		}
+		if err != nil {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s", err.Error()))
+			return result, nil
+		}
+		result.PRURL = fmt.Sprintf("%s/compare/%s...%s?expand=1", webURL, mainBranch, currentBranch)
+		return result, nil
+	}
+	logDebug("Checking for existing PR...")
+	prNumber, err := g.forge.FindPR(currentBranch)
+	if err != nil {
+		logError(err.Error())
+		return result, err
+	}
+	commitMsgs, _ := g.pushGit.GetCommitMessages(mainBranch, currentBranch)
+	diff, _ := g.pushGit.GetDiff(false)
+	ticketNumber := g.detectTicketNumber(currentBranch)
+	if prNumber != "" {
+		logMessage(color.FgCyan, fmt.Sprintf("🔄 Pull request #%s found. Updating body...", color.New(color.Bold).Sprint(prNumber)))
+		if err := g.updatePRBody(prNumber, currentBranch, commitMsgs, diff, ticketNumber, opts); err != nil {
+			logError(err.Error())
+			return result, err
+		}
+	} else {
+		logMessage(color.FgGreen, "🚀 No existing PR found. Creating new PR...")
+		if err := g.createNewPR(currentBranch, commitMsgs, diff, ticketNumber, opts); err != nil {
+			logError(err.Error())
+			return result, err
+		}
+		prNumber, _ = g.forge.FindPR(currentBranch)
+		result.Created = prNumber != ""
+	}
+	result.PRNumber = prNumber
+	if prNumber != "" {
+		result.PRURL = g.forge.PRURL(prNumber)
+	}
+	return result, nil
+}
+
+// Ship commits the changes, pushes the branch and creates or updates its pull
+// request in one go, stopping when the commit is canceled. pushArgs are passed
+// to git push.
+func (g *GitAI) Ship(pushArgs []string) (PushResult, error) {
+	hasChanges, err := g.gitOps.HasChanges()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
+		return PushResult{}, err
+	}
+	if hasChanges {
+		head, _ := runCmd("git", "rev-parse", "--verify", "--quiet", "HEAD")
+		if err := g.Commit(nil, CommitOptions{}); err != nil {
+			return PushResult{}, err
+		}
+		if after, _ := runCmd("git", "rev-parse", "--verify", "--quiet", "HEAD"); after == head {
+			logMessage(color.FgYellow, "🚫 Nothing was committed. Not pushing.")
+			return PushResult{}, nil
+		}
+	}
+	return g.Push(pushArgs, PushOptions{})
+}
+
+// PrintShipPlan prints what Ship would do: the staging decision, the commit
+// message, the push command and the pull request it would create or update.
+// The AI writes the commit message and PR title, but nothing is staged,
+// committed, pushed or changed on GitHub.
+func (g *GitAI) PrintShipPlan(pushArgs []string) error {
+	logMessage(color.FgCyan, "🧪 Dry run: nothing will be staged, committed, pushed or changed on GitHub.")
+	branch, err := g.pushGit.GetCurrentBranch()
+	if err != nil {
+		logError(fmt.Sprintf("Could not get current branch: %s", err.Error()))
+		return err
+	}
+	stagedDiff, _ := g.gitOps.GetDiff(true)
+	unstaged, _ := g.gitOps.GetChangedFiles(false)
+	hasChanges, err := g.gitOps.HasChanges()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
+		return err
+	}
+	var staging string
+	stageAll := false
+	switch {
+	case strings.TrimSpace(stagedDiff) != "":
+		staging = "use the staged changes"
+		if len(unstaged) > 0 {
+			staging += fmt.Sprintf(" (MIXED_CHANGES=%s for %d file(s) with unstaged changes)", viper.GetString("MIXED_CHANGES"), len(unstaged))
+		}
+	case hasChanges:
+		stageAll, staging = true, "stage all changes"
+		if exclude := viper.GetString("AUTO_STAGE_EXCLUDE"); exclude != "" {
+			staging += " except AUTO_STAGE_EXCLUDE=" + exclude
+		}
+	default:
+		staging = "nothing to stage or commit"
+	}
+
+	// Stage into a copy of the index so the message is generated from the same
+	// staged diff and commit context as Ship would use
+	var diff, subject, message string
+	err = withTemporaryIndex(func() error {
+		if stageAll {
+			if err := g.gitOps.StageAllChanges(); err != nil {
+				return fmt.Errorf("failed to stage changes: %w", err)
+			}
+		}
+		if diff, _ = g.gitOps.GetDiff(true); strings.TrimSpace(diff) == "" {
+			return nil
+		}
+		logMessage(color.FgCyan, "🧠 Generating the commit message...")
+		message, err = g.GenerateMessage(taskCommit, g.systemInstructions(), commitInstructions(), commitInputData(diff, g.commitContext(CommitOptions{})))
+		if err != nil {
+			return fmt.Errorf("OpenAI error: %s", err.Error())
+		}
+		message = fixCommitMessage(message)
+		subject, _ = splitCommitSubject(message)
 		return nil
+	})
+	if err != nil {
+		logError(err.Error())
+		return err
+	}
+
+	mainBranch, _ := baseBranch(branch)
+	hasCommits, err := g.pushGit.HasCommitsToPush(mainBranch, branch)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for commits to push: %s", err.Error()))
+		return err
+	}
+	push := "nothing to push"
+	switch {
+	case message == "" && hasCommits && g.pushGit.IsPushed():
+		push = "already pushed, resume at the pull request step"
+	case message != "" || hasCommits:
+		push = strings.Join(append([]string{"git", "push", "origin", branch}, pushArgs...), " ")
+	}
+
+	pr := "none, nothing to push"
+	if message != "" || hasCommits {
+		if pr, err = g.shipPRPlan(branch, mainBranch, subject, diff); err != nil {
+			logError(err.Error())
+			return err
+		}
+	}
+
+	fmt.Printf("Branch:  %s\n", branch)
+	fmt.Printf("Stage:   %s\n", staging)
+	if message == "" {
+		fmt.Println("Commit:  none")
+	} else {
+		fmt.Println("Commit:")
+		for _, line := range strings.Split(message, "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	fmt.Printf("Push:    %s\n", push)
+	fmt.Printf("PR:      %s\n", pr)
+	return nil
+}
+
+// withTemporaryIndex runs fn with git using a copy of the index, so anything
+// fn stages leaves the real index untouched.
+func withTemporaryIndex(fn func() error) error {
+	indexPath, err := runCmd("git", "rev-parse", "--path-format=absolute", "--git-path", "index")
+	if err != nil {
+		return fmt.Errorf("failed to locate the index: %s", indexPath)
+	}
+	tmp, err := os.CreateTemp("", "gai-index-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if data, err := os.ReadFile(indexPath); err == nil {
+		if err := os.WriteFile(tmp.Name(), data, 0o600); err != nil {
+			return err
+		}
+	} else {
+		// Without commits there may be no index yet, git creates it
+		os.Remove(tmp.Name())
+	}
+	previous, wasSet := os.LookupEnv("GIT_INDEX_FILE")
+	os.Setenv("GIT_INDEX_FILE", tmp.Name())
+	defer func() {
+		if wasSet {
+			os.Setenv("GIT_INDEX_FILE", previous)
+		} else {
+			os.Unsetenv("GIT_INDEX_FILE")
+		}
+	}()
+	return fn()
+}
+
+// shipPRPlan describes the pull request Ship would create or update. subject
+// is the subject of the commit Ship would make, if any.
+func (g *GitAI) shipPRPlan(branch, mainBranch, subject, diff string) (string, error) {
+	if !g.forge.Available() {
+		return fmt.Sprintf("open one manually, gh is not installed (compare %s...%s)", mainBranch, branch), nil
+	}
+	number, err := g.forge.FindPR(branch)
+	if err != nil {
+		return "", err
+	}
+	if number != "" {
+		return fmt.Sprintf("update the body of #%s (%s)", number, g.forge.PRURL(number)), nil
+	}
+	commitMsgs, _ := g.pushGit.GetCommitMessages(mainBranch, branch)
+	if subject != "" {
+		commitMsgs = strings.TrimSpace(subject + "\n" + commitMsgs)
+	}
+	logMessage(color.FgCyan, "🧠 Generating the PR title...")
+	title, err := g.generatePRTitle(branch, commitMsgs, diff, g.detectTicketNumber(branch))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("create a draft PR titled %q", title), nil
+}
+
+// warnBranchHygiene warns when the branch is behind the main branch or
+// contains merge commits, both of which are best rebased away before a PR.
+func (g *GitAI) warnBranchHygiene(mainBranch, branch string) {
+	base := "origin/" + mainBranch
+	if !g.pushGit.RefExists(base) {
+		return
+	}
+	if _, behind, err := g.pushGit.AheadBehind(base, branch); err != nil {
+		logDebug(err.Error())
+	} else if behind > 0 {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s is %d commit(s) behind %s. Consider rebasing before the pull request.", branch, behind, base))
+	}
+	if merges, err := g.pushGit.CountMerges(fmt.Sprintf("%s..%s", base, branch)); err == nil && merges > 0 {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s contains %d merge commit(s). Consider rebasing onto %s for a linear history.", branch, merges, base))
+	}
+}
+
+// printPushResult reports the outcome of a push to the user.
+func printPushResult(result PushResult, opts PushOptions) {
+	switch {
+	case !result.Pushed:
+		logMessage(color.FgYellow, "ℹ️ Nothing to push. Exiting.")
+	case opts.SkipPR:
+		logMessage(color.FgYellow, "ℹ️ Skipping pull request creation (--no-pr).")
+	case result.PRNumber == "" && result.PRURL != "":
+		logMessage(color.FgCyan, fmt.Sprintf("🔗 GitHub CLI not available. Open a pull request at: %s", result.PRURL))
+	case result.PRNumber != "":
+		action := "updated"
+		if result.Created {
+			action = "created"
+		}
+		logMessage(color.FgGreen, fmt.Sprintf("🔗 Pull request #%s %s: %s", result.PRNumber, action, result.PRURL))
+	}
+}
+
+func (g *GitAI) pushChanges(mainBranch string, extraArgs []string) error {
+	if !g.pushGit.RemoteBranchExists("origin", mainBranch) {
+		logMessage(color.FgYellow, fmt.Sprintf("ℹ️ origin/%s does not exist yet. Skipping fetch.", mainBranch))
+	} else {
+		logMessage(color.FgBlue, "🔍 Fetching latest from origin...")
+		if err := g.pushGit.Fetch("origin", mainBranch); err != nil {
+			return err
+		}
+	}
+	currentBranch, err := g.pushGit.GetCurrentBranch()
+	if err != nil {
+		return fmt.Errorf("failed to get current branch: %w", err)
+	}
+	logDebug(fmt.Sprintf("Current branch: %s", currentBranch))
+	return g.pushGit.Push(currentBranch, "origin", extraArgs)
+}
+
+// baseBranch returns the base branch of the branch from the first matching
+// BRANCH_BASE_MAP entry ("^feature/=develop,^release/=main"), or MAIN_BRANCH
+// when none matches. mapped reports whether an entry matched.
+func baseBranch(branch string) (base string, mapped bool) {
+	for _, entry := range splitList(viper.GetString("BRANCH_BASE_MAP")) {
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			continue
+		}
+		re, err := regexp.Compile(strings.TrimSpace(entry[:i]))
+		if err != nil {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ Ignoring invalid BRANCH_BASE_MAP pattern %q: %s", entry[:i], err.Error()))
+			continue
+		}
+		if re.MatchString(branch) {
+			base = strings.TrimSpace(entry[i+1:])
+			logDebug(fmt.Sprintf("Branch %s targets %s (BRANCH_BASE_MAP)", branch, base))
+			return base, true
+		}
+	}
+	return viper.GetString("MAIN_BRANCH"), false
+}
+
+func (g *GitAI) getPRBody(prNumber string) string {
+	logDebug(fmt.Sprintf("Fetching current body of PR #%s", prNumber))
+	out, err := runCmd("gh", "pr", "view", prNumber, "--json", "body", "--jq", ".body")
+	if err != nil {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Could not fetch current PR body: %s", out))
+		return ""
+	}
+	return out
+}
+
+// prSection is a markdown heading line and the content below it. The text
+// before the first heading has an empty heading.
+type prSection struct {
+	heading string
+	content string
+}
+
+// atxHeadingRe matches Markdown ATX headings, but not body lines that merely
+// start with "#", like issue references.
+var atxHeadingRe = regexp.MustCompile(`^#{1,6}(\s|$)`)
+
+func parseSections(body string) []prSection {
+	sections := []prSection{{}}
+	for _, line := range strings.Split(body, "\n") {
+		if atxHeadingRe.MatchString(line) {
+			sections = append(sections, prSection{heading: line})
+			continue
+		}
+		last := &sections[len(sections)-1]
+		last.content += line + "\n"
+	}
+	return sections
+}
+
+func renderSections(sections []prSection) string {
+	var b strings.Builder
+	for _, section := range sections {
+		if section.heading != "" {
+			b.WriteString(section.heading + "\n")
+		}
+		b.WriteString(section.content)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func sectionTitle(heading string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimLeft(heading, "#")))
+}
+
+// preservePRSections replaces the listed sections of the generated body with
+// their current content, appending the ones the model dropped.
+func preservePRSections(currentBody, generatedBody string, headings []string) string {
+	current := map[string]prSection{}
+	for _, section := range parseSections(currentBody) {
+		current[sectionTitle(section.heading)] = section
+	}
+	sections := parseSections(generatedBody)
+	seen := map[string]bool{}
+	for i, section := range sections {
+		title := sectionTitle(section.heading)
+		if old, ok := current[title]; ok && section.heading != "" && hasSection(headings, title) {
+			sections[i] = old
+			seen[title] = true
+		}
+	}
+	for _, heading := range headings {
+		title := sectionTitle(heading)
+		if old, ok := current[title]; ok && !seen[title] {
+			logDebug(fmt.Sprintf("Restoring dropped section %q", heading))
+			if !strings.HasSuffix(sections[len(sections)-1].content, "\n\n") {
+				sections[len(sections)-1].content += "\n"
+			}
+			sections = append(sections, old)
+		}
+	}
+	return renderSections(sections)
+}
+
+func hasSection(list []string, value string) bool {
+	for _, item := range list {
+		if sectionTitle(item) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// regeneratePRSection asks which section of the current PR body to rewrite and
+// returns the body with only that section regenerated.
+func (g *GitAI) regeneratePRSection(prNumber, prBodyInput string) (string, error) {
+	currentBody := g.getPRBody(prNumber)
+	sections := parseSections(currentBody)
+	var headings []string
+	for _, section := range sections {
+		if section.heading != "" {
+			headings = append(headings, section.heading)
+		}
+	}
+	if len(headings) == 0 {
+		return "", GitAIException{fmt.Sprintf("PR #%s has no headings to pick a section from", prNumber)}
+	}
+	selected := promptSelection("🧩 Select the section to regenerate", headings, nil)
+	if len(selected) == 0 {
+		return "", GitAIException{"No section selected"}
+	}
+	if len(selected) > 1 {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Only one section is regenerated at a time, using %s", selected[0]))
+	}
+	heading := selected[0]
+	prBodyInput += fmt.Sprintf("CURRENT PULL REQUEST BODY:\n%s\nRewrite only the section %q.\n", currentBody, sectionTitle(heading))
+	instructions := g.prBodyInstructions() + "\n\n**SINGLE SECTION (overrides the OUTPUT FORMAT above):**\n" +
+		"Return only the new content of the requested section, without its heading. The rest of the current body was edited by the author and stays as it is."
+	logDebug(fmt.Sprintf("Regenerating PR body section %q with AI", heading))
+	content, err := g.GenerateMessage(taskPRBody, g.systemInstructions(), instructions, prBodyInput)
+	if err != nil {
+		return "", fmt.Errorf("failed generating PR body section: %w", err)
+	}
+	content = strings.TrimSpace(content)
+	if first, rest, _ := strings.Cut(content, "\n"); sectionTitle(first) == sectionTitle(heading) {
+		content = strings.TrimSpace(rest)
+	}
+	for i, section := range sections {
+		if section.heading == heading {
+			sections[i].content = content + "\n\n"
+			break
+		}
+	}
+	return renderSections(sections), nil
+}
+
+func (g *GitAI) updatePRBody(prNumber, branch, commitMsgs, diff, ticketNumber string, opts PushOptions) error {
+	logDebug("Building input data for PR body update")
+	prBodyInput := buildInputData(ticketNumber, branch, "", commitMsgs, diff)
+	var prBodyAI string
+	var err error
+	if opts.RegenerateSection {
+		prBodyAI, err = g.regeneratePRSection(prNumber, prBodyInput)
+		if err != nil {
+			return err
+		}
+	} else {
+		preserved := splitList(viper.GetString("PR_PRESERVE_SECTIONS"))
+		currentBody := ""
+		if len(preserved) > 0 {
+			currentBody = g.getPRBody(prNumber)
+			prBodyInput += fmt.Sprintf("CURRENT PULL REQUEST BODY:\n%s\nKeep these sections exactly as they are: %s\n",
+				currentBody, strings.Join(preserved, ", "))
+		}
+		logDebug("Generating new PR body with AI")
+		prBodyAI, err = g.GenerateMessage(taskPRBody, g.systemInstructions(), g.prBodyInstructions(), prBodyInput)
+		if err != nil {
+			return fmt.Errorf("failed generating PR body: %w", err)
+		}
+		if len(preserved) > 0 {
+			prBodyAI = preservePRSections(currentBody, prBodyAI, preserved)
+		}
+	}
+	editedBody, savedBody := g.reviewAIOutput(prBodyAI)
+	if !savedBody {
+		return fmt.Errorf("PR update canceled")
+	}
+	finalBody := appendPRFooter(editedBody, ticketNumber)
+	if opts.Render && !reviewRenderedBody(finalBody) {
+		return fmt.Errorf("PR update canceled")
+	}
+	bodyFile, err := writeBodyFile(finalBody)
+	if err != nil {
+		return fmt.Errorf("failed to write PR body: %w", err)
+	}
+	defer os.Remove(bodyFile)
+	logMessage(color.FgBlue, "📝 Updating PR on GitHub...")
+	out, createErr := runCmd("gh", "pr", "edit", prNumber, "--body-file", bodyFile)
+	if createErr != nil {
+		return fmt.Errorf("failed to update PR: %w\nOutput: %s", createErr, out)
+	}
+	logMessage(color.FgGreen, "✅ Pull Request updated successfully!")
+	return nil
+}
+
+var (
+	mdHeadingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBulletRe   = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	mdTaskRe     = regexp.MustCompile(`^\[([ xX])\]\s+(.*)$`)
+	mdBoldRe     = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdCodeSpanRe = regexp.MustCompile("`([^`]+)`")
+)
+
+// renderInline styles bold text and code spans of a markdown line.
+func renderInline(line string) string {
+	line = mdCodeSpanRe.ReplaceAllStringFunc(line, func(m string) string {
+		return color.New(color.FgCyan).Sprint(strings.Trim(m, "`"))
+	})
+	return mdBoldRe.ReplaceAllStringFunc(line, func(m string) string {
+		return color.New(color.Bold).Sprint(m[2 : len(m)-2])
+	})
+}
+
+// renderMarkdown renders the common markdown of PR bodies (headings, lists,
+// task lists, quotes, code blocks, bold and code spans) for the terminal. The
+// colors are dropped when the terminal has none, leaving readable text.
+func renderMarkdown(md string) string {
+	var out []string
+	inCode := false
+	for _, line := range strings.Split(md, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			inCode = !inCode
+		case inCode:
+			out = append(out, color.New(color.FgCyan).Sprint("    "+line))
+		case mdHeadingRe.MatchString(line):
+			m := mdHeadingRe.FindStringSubmatch(line)
+			heading := color.New(color.Bold, color.FgMagenta)
+			if len(m[1]) > 1 {
+				heading = color.New(color.Bold)
+			}
+			out = append(out, "", heading.Sprint(renderInline(m[2])))
+		case mdBulletRe.MatchString(line):
+			m := mdBulletRe.FindStringSubmatch(line)
+			item, bullet := m[2], "•"
+			if t := mdTaskRe.FindStringSubmatch(item); t != nil {
+				item, bullet = t[2], "☐"
+				if t[1] != " " {
+					bullet = "☑"
+				}
+			}
+			out = append(out, fmt.Sprintf("%s  %s %s", m[1], bullet, renderInline(item)))
+		case strings.HasPrefix(trimmed, ">"):
+			out = append(out, color.New(color.Faint).Sprint("│ "+strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))))
+		case trimmed == "---" || trimmed == "***":
+			out = append(out, strings.Repeat("─", 40))
+		default:
+			out = append(out, renderInline(line))
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// reviewRenderedBody prints the rendered PR body on stderr and asks whether
+// to go on with it.
+func reviewRenderedBody(body string) bool {
+	fmt.Fprintf(os.Stderr, "\n%s\n\n", renderMarkdown(body))
+	return confirm("Use this pull request body?")
+}
+
+// prBodyFooter returns PR_BODY_FOOTER, read from the file it names or used as
+// inline text, with {{.Ticket}} replaced by the ticket number.
+func prBodyFooter(ticketNumber string) string {
+	footer := viper.GetString("PR_BODY_FOOTER")
+	if footer == "" {
+		return ""
+	}
+	if data, err := os.ReadFile(footer); err == nil {
+		footer = string(data)
 	}
-	logMessage(color.FgCyan, "🗂️ No changes staged. Automatically staging all...")
-	if err := g.gitOps.StageAllChanges(); err != nil {
-		logError(fmt.Sprintf("Failed to stage changes: %s", err.Error()))
-		return err
+	tmpl, err := template.New("footer").Parse(footer)
+	if err != nil {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Invalid PR_BODY_FOOTER template: %s", err.Error()))
+		return strings.TrimSpace(footer)
 	}
-	return nil
+	var b strings.Builder
+	if err := tmpl.Execute(&b, struct{ Ticket string }{ticketNumber}); err != nil {
+		logMessage(color.FgYellow, fmt.Sprintf("⚠️ Invalid PR_BODY_FOOTER template: %s", err.Error()))
+		return strings.TrimSpace(footer)
+	}
+	return strings.TrimSpace(b.String())
 }
 
-func (g *GitAI) Stash(extraArgs []string) error {
-	logMessage(color.FgGreen, "💾 Stashing changes with AI-generated message...")
-	message, ok := g.generateDiffBasedMessage(false)
-	if !ok {
-		logMessage(color.FgYellow, "🚫 Stash canceled by user.")
-		return nil
+// appendPRFooter adds the PR_BODY_FOOTER below the edited body unless the
+// body already contains it.
+func appendPRFooter(body, ticketNumber string) string {
+	footer := prBodyFooter(ticketNumber)
+	if footer == "" || strings.Contains(body, footer) {
+		return body
 	}
-	stashArgs := append([]string{"stash", "push", "-m", message}, extraArgs...)
-	logDebug(fmt.Sprintf("Executing command: git %s", strings.Join(stashArgs, " ")))
-	out, err := runCmd("git", stashArgs...)
+	return strings.TrimRight(body, "\n") + "\n\n" + footer + "\n"
+}
+
+// writeBodyFile writes a PR body to a temporary file passed to gh with
+// --body-file, which avoids argument length limits. The caller removes it.
+func writeBodyFile(body string) (string, error) {
+	f, err := ioutil.TempFile("", "gai-pr-body-*.md")
 	if err != nil {
-		logError(fmt.Sprintf("Failed to stash changes: %s\nOutput: %s", err.Error(), out))
-		return fmt.Errorf("failed to stash changes: %w", err)
+		return "", err
 	}
-	logMessage(color.FgGreen, "🗄️ Changes stashed successfully!")
-	return nil
+	defer f.Close()
+	if _, err := f.WriteString(body); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
 }
 
-func (g *GitAI) Push(extraArgs []string) error {
-	logMessage(color.FgBlue, "🔄 Preparing to push changes...")
-	currentBranch, err := g.gitOps.GetCurrentBranch()
+// CheckoutPR checks out the pull request branch with gh, refusing to run over
+// local changes.
+func (g *GitAI) CheckoutPR(prNumber string) error {
+	hasChanges, err := g.gitOps.HasChanges()
 	if err != nil {
-		logError(fmt.Sprintf("Could not get current branch: %s", err.Error()))
-		return err
+		return fmt.Errorf("failed to check for local changes: %w", err)
 	}
-	logDebug(fmt.Sprintf("Current branch: %s", currentBranch))
-	hasCommits, err := g.gitOps.HasCommitsToPush(viper.GetString("MAIN_BRANCH"), currentBranch)
+	if hasChanges {
+		return GitAIException{"Local changes would conflict with the checkout. Commit or stash them first."}
+	}
+	logMessage(color.FgCyan, fmt.Sprintf("🔀 Checking out pull request #%s...", prNumber))
+	out, err := runCmd("gh", "pr", "checkout", prNumber)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to check for commits to push: %s", err.Error()))
-		return err
+		return GitAIException{fmt.Sprintf("Cannot check out pull request #%s: %s", prNumber, out)}
 	}
-	if !hasCommits {
-		logMessage(color.FgYellow, "ℹ️ Nothing to push. Exiting.")
-		return nil
+	logMessage(color.FgGreen, fmt.Sprintf("✅ Checked out pull request #%s.", prNumber))
+	return nil
+}
+
+// ReviewPR generates an AI summary of the pull request diff.
+func (g *GitAI) ReviewPR(prNumber string) (string, error) {
+	logDebug(fmt.Sprintf("Fetching diff of PR #%s", prNumber))
+	diff, err := runCmd("gh", "pr", "diff", prNumber)
+	if err != nil {
+		return "", fmt.Errorf("failed to get PR diff: %w\n%s", err, diff)
 	}
-	logMessage(color.FgBlue, "⬆️ Pushing changes to remote...")
-	if err := g.pushChanges(extraArgs); err != nil {
-		logError(err.Error())
-		return err
+	title, _ := runCmd("gh", "pr", "view", prNumber, "--json", "title", "--jq", ".title")
+	body := g.getPRBody(prNumber)
+	input := buildInputData("", "", title, "", diff) + fmt.Sprintf("PULL REQUEST BODY:\n%s\n", body)
+	return g.GenerateMessage(taskReview, g.systemInstructions(), prReviewInstructions, input)
+}
+
+// SuggestGitignore asks the model for .gitignore patterns covering the
+// untracked files and returns the ones not already in the file.
+func (g *GitAI) SuggestGitignore(path string) ([]string, error) {
+	untracked, err := g.gitOps.GetUntrackedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list untracked files: %w", err)
 	}
-	logDebug("Checking for existing PR...")
-	prNumber, err := g.getExistingPRNumber(currentBranch)
+	if len(untracked) == 0 {
+		return nil, nil
+	}
+	existing, _ := ioutil.ReadFile(path)
+	input := fmt.Sprintf("UNTRACKED FILES:\n%s\n\nEXISTING .gitignore:\n%s\n", strings.Join(untracked, "\n"), existing)
+	response, err := g.GenerateMessage(taskGitignore, g.systemInstructions(), gitignoreInstructions, input)
 	if err != nil {
-		logError(err.Error())
-		return err
+		return nil, err
 	}
-	commitMsgs, _ := g.gitOps.GetCommitMessages(viper.GetString("MAIN_BRANCH"), currentBranch)
-	diff, _ := g.gitOps.GetDiff(false)
-	ticketNumber := g.detectTicketNumber(currentBranch)
-	if prNumber != "" {
-		logMessage(color.FgCyan, fmt.Sprintf("🔄 Pull request #%s found. Updating body...", color.New(color.Bold).Sprint(prNumber)))
-		if err := g.updatePRBody(prNumber, currentBranch, commitMsgs, diff, ticketNumber); err != nil {
-			logError(err.Error())
-			return err
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		seen[strings.TrimSpace(line)] = true
+	}
+	var entries []string
+	for _, line := range strings.Split(response, "\n") {
+		entry := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*"))
+		if entry == "" || strings.HasPrefix(entry, "#") || strings.HasPrefix(entry, "```") || seen[entry] {
+			continue
 		}
-	} else {
-		logMessage(color.FgGreen, "🚀 No existing PR found. Creating new PR...")
-		g.createNewPR(currentBranch, commitMsgs, diff, ticketNumber)
-		prNumber, _ = g.getExistingPRNumber(currentBranch)
+		seen[entry] = true
+		entries = append(entries, entry)
 	}
-	g.openPRInBrowser(prNumber)
-	return nil
+	return entries, nil
 }
 
-func (g *GitAI) pushChanges(extraArgs []string) error {
-	logMessage(color.FgBlue, "🔍 Fetching latest from origin...")
-	if err := g.gitOps.Fetch("origin", viper.GetString("MAIN_BRANCH")); err != nil {
+// appendGitignore adds the entries to the .gitignore at path, creating it
+// when missing.
+func appendGitignore(path string, entries []string) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	currentBranch, err := g.gitOps.GetCurrentBranch()
+	content := strings.Join(entries, "\n") + "\n"
+	if len(existing) > 0 && !strings.HasSuffix(string(existing), "\n") {
+		content = "\n" + content
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to get current branch: %w", err)
+		return err
 	}
-	logDebug(fmt.Sprintf("Current branch: %s", currentBranch))
-	return g.gitOps.Push(currentBranch, "origin", extraArgs)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	return err
 }
 
-func (g *GitAI) getExistingPRNumber(branch string) (string, error) {
-	logDebug(fmt.Sprintf("Listing PRs for branch %s", branch))
-	out, err := runCmd("gh", "pr", "list", "--head", branch, "--json", "number")
+func (g *GitAI) openPRInBrowser(prNumber string) {
+	if prNumber == "" {
+		logMessage(color.FgYellow, "⚠️ No PR number to open in browser.")
+		return
+	}
+	logMessage(color.FgGreen, "🌐 Opening PR in browser...")
+	runCmd("gh", "pr", "view", prNumber, "--web")
+}
+
+func (g *GitAI) detectTicketNumber(branch string) string {
+	logDebug(fmt.Sprintf("Detecting JIRA ticket pattern in branch name: %s", branch))
+	for _, pattern := range splitPatterns(viper.GetString("TICKET_PATTERNS")) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logError(fmt.Sprintf("Invalid ticket pattern %q: %s", pattern, err.Error()))
+			continue
+		}
+		// The first capture group, when present, is the ticket number
+		if m := re.FindStringSubmatch(branch); m != nil {
+			if len(m) > 1 && m[1] != "" {
+				return m[1]
+			}
+			return m[0]
+		}
+	}
+	return "NO-TICKET"
+}
+
+// getMergedPRsSince lists the pull requests merged on or after the given date,
+// one "#<number> <title>" entry per line.
+func (g *GitAI) getMergedPRsSince(date string) (string, error) {
+	args := []string{"pr", "list", "--state", "merged", "--limit", "200", "--json", "number,title,labels"}
+	if date != "" {
+		args = append(args, "--search", fmt.Sprintf("merged:>=%s", date))
+	}
+	logDebug(fmt.Sprintf("Listing merged PRs since %s", date))
+	out, err := runCmd("gh", args...)
 	if err != nil {
-		return "", fmt.Errorf("failed to check existing PRs: %w\n%s", err, out)
+		return "", fmt.Errorf("failed to list merged PRs: %w\n%s", err, out)
 	}
 	var prList []struct {
-		Number int `json:"number"`
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		Labels []struct {
+			Name string `json:"name"`
+		} `json:"labels"`
 	}
 	if e := json.Unmarshal([]byte(out), &prList); e != nil {
 		return "", fmt.Errorf("failed to parse PR list JSON: %w", e)
 	}
-	if len(prList) > 0 {
-		return fmt.Sprintf("%d", prList[0].Number), nil
+	var lines []string
+	for _, pr := range prList {
+		line := fmt.Sprintf("#%d %s", pr.Number, pr.Title)
+		var labels []string
+		for _, l := range pr.Labels {
+			labels = append(labels, l.Name)
+		}
+		if len(labels) > 0 {
+			line += fmt.Sprintf(" [labels: %s]", strings.Join(labels, ", "))
+		}
+		lines = append(lines, line)
 	}
-	return "", nil
+	return strings.Join(lines, "\n"), nil
 }
 
-func (g *GitAI) updatePRBody(prNumber, branch, commitMsgs, diff, ticketNumber string) error {
-	logDebug("Building input data for PR body update")
-	prBodyInput := buildInputData(ticketNumber, branch, "", commitMsgs, diff)
-	logDebug("Generating new PR body with AI")
-	prBodyAI, err := g.GenerateMessage(embeddedSystemInstructions, embeddedPRBodyFormattingInstructions, prBodyInput)
+// GenerateReleaseNotes builds release notes for everything since the last
+// tag, either from merged pull requests or from raw commit subjects.
+func (g *GitAI) GenerateReleaseNotes(byPR bool) (string, error) {
+	lastTag, err := g.gitOps.GetLastTag()
 	if err != nil {
-		return fmt.Errorf("failed generating PR body: %w", err)
+		logMessage(color.FgYellow, "ℹ️ No tags found. Using the whole history.")
+		lastTag = ""
 	}
-	editedBody, savedBody := g.editContentInEditor(prBodyAI)
-	if !savedBody {
-		return fmt.Errorf("PR update canceled")
+	var entries string
+	if byPR {
+		date := ""
+		if lastTag != "" {
+			date, _ = g.gitOps.GetTagDate(lastTag)
+		}
+		if !hasGH() {
+			logMessage(color.FgYellow, "⚠️ GitHub CLI not available. Falling back to commit-based notes.")
+		} else if entries, err = g.getMergedPRsSince(date); err != nil {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ %s. Falling back to commit-based notes.", err.Error()))
+			entries = ""
+		}
 	}
-	logMessage(color.FgBlue, "📝 Updating PR on GitHub...")
-	out, createErr := runCmd("gh", "pr", "edit", prNumber, "--body", editedBody)
-	if createErr != nil {
-		return fmt.Errorf("failed to update PR: %w\nOutput: %s", createErr, out)
+	label := "MERGED PULL REQUESTS"
+	if entries == "" {
+		label = "COMMIT MESSAGES LIST"
+		if entries, err = g.gitOps.GetCommitsSince(lastTag); err != nil {
+			return "", fmt.Errorf("failed to list commits: %w", err)
+		}
 	}
-	logMessage(color.FgGreen, "✅ Pull Request updated successfully!")
-	return nil
+	if strings.TrimSpace(entries) == "" {
+		return "", GitAIException{"Nothing to release since " + lastTag}
+	}
+	inputData := fmt.Sprintf("INPUT:\nPREVIOUS TAG: %s\n%s:\n%s\n", lastTag, label, entries)
+	return g.GenerateMessage(taskReleaseNotes, g.systemInstructions(), releaseNotesInstructions, inputData)
 }
 
-func (g *GitAI) openPRInBrowser(prNumber string) {
-	if prNumber == "" {
-		logMessage(color.FgYellow, "⚠️ No PR number to open in browser.")
-		return
+// Release commits the pending changes as the release commit of version, tags
+// it with AI-generated release notes and optionally pushes both. It refuses
+// when there are no pending changes, e.g. the version bump, to commit.
+func (g *GitAI) Release(version string, push bool) error {
+	if g.gitOps.RefExists("refs/tags/" + version) {
+		logError(fmt.Sprintf("Tag %s already exists", version))
+		return GitAIException{"Tag " + version + " already exists"}
 	}
-	logMessage(color.FgGreen, "🌐 Opening PR in browser...")
-	runCmd("gh", "pr", "view", prNumber, "--web")
+	hasChanges, err := g.gitOps.HasChanges()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to check for changes: %s", err.Error()))
+		return err
+	}
+	if !hasChanges {
+		logError(fmt.Sprintf("Nothing to commit for release %s. Make the release changes, e.g. the version bump, first.", version))
+		return GitAIException{"Nothing to commit for the release"}
+	}
+	logMessage(color.FgBlue, fmt.Sprintf("🔖 Preparing release %s...", version))
+	if err := g.stageChangesIfNeeded(); err != nil {
+		return err
+	}
+	message, ok := g.generateDiffBasedMessage(true, fmt.Sprintf("NOTE: This is the release commit of version %s. Use the 🔖 gitmoji.", version))
+	if !ok {
+		logMessage(color.FgYellow, "🚫 Release canceled by user.")
+		return nil
+	}
+	if err := g.commitWithMessage(message, nil); err != nil {
+		return err
+	}
+
+	// The notes are generated after the commit so they cover the release commit
+	notes, err := g.GenerateReleaseNotes(false)
+	if err != nil {
+		logError(fmt.Sprintf("Failed to generate release notes: %s. The release commit is made but not tagged, tag it with 'git tag -a %s'.", err.Error(), version))
+		return err
+	}
+	if err := g.gitOps.CreateTag(version, notes); err != nil {
+		return err
+	}
+	if !push {
+		return nil
+	}
+	branch, err := g.gitOps.GetCurrentBranch()
+	if err != nil {
+		logError(fmt.Sprintf("Failed to get current branch: %s", err.Error()))
+		return err
+	}
+	if err := g.gitOps.Push(branch, "origin", nil); err != nil {
+		return err
+	}
+	return g.gitOps.PushTag("origin", version)
 }
 
-func (g *GitAI) detectTicketNumber(branch string) string {
-	logDebug(fmt.Sprintf("Detecting JIRA ticket pattern in branch name: %s", branch))
-	re := regexp.MustCompile(`[A-Z]+-\d+`)
-	match := re.FindString(branch)
-	if match != "" {
-		return match
+// splitList splits a comma-separated config value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return "NO-TICKET"
+	return items
+}
+
+// splitPatterns splits a config value of regexes separated by semicolons or
+// newlines. Commas are left alone because they are part of {m,n} quantifiers.
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// promptSelection prints the numbered options on stderr and reads a
+// comma-separated list of numbers from stdin. An empty answer keeps defaults.
+func promptSelection(title string, options, defaults []string) []string {
+	if len(options) == 0 {
+		return defaults
+	}
+	logMessage(color.FgCyan, fmt.Sprintf("%s (comma-separated numbers, empty keeps %v):", title, defaults))
+	for i, option := range options {
+		fmt.Fprintf(os.Stderr, "  %d) %s\n", i+1, option)
+	}
+	fmt.Fprint(os.Stderr, "> ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) == "" {
+		return defaults
+	}
+	var selected []string
+	for _, field := range splitList(answer) {
+		var index int
+		if _, err := fmt.Sscanf(field, "%d", &index); err != nil || index < 1 || index > len(options) {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ Ignoring invalid choice %q", field))
+			continue
+		}
+		selected = append(selected, options[index-1])
+	}
+	return selected
+}
+
+// confirm asks a yes/no question on stderr and reports whether the answer
+// was yes. Anything else, including an empty answer, means no. With --yes the
+// question is skipped.
+func confirm(question string) bool {
+	if viper.GetBool("ASSUME_YES") {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func ghLines(args ...string) []string {
+	out, err := runCmd("gh", args...)
+	if err != nil {
+		logDebug(fmt.Sprintf("gh %s failed: %s", strings.Join(args, " "), out))
+		return nil
+	}
+	return splitList(strings.ReplaceAll(out, "\n", ","))
+}
+
+// selectPRMeta returns the labels and reviewers for a new PR, asking the user
+// to choose them when interactive mode is enabled on a terminal.
+func (g *GitAI) selectPRMeta(interactive bool) (labels, reviewers []string) {
+	labels = splitList(viper.GetString("PR_LABELS"))
+	reviewers = splitList(viper.GetString("PR_REVIEWERS"))
+	if !interactive || !isatty.IsTerminal(os.Stdin.Fd()) {
+		return labels, reviewers
+	}
+	labels = promptSelection("🏷️ Select labels", ghLines("label", "list", "--json", "name", "--jq", ".[].name"), labels)
+	reviewers = promptSelection("👥 Select reviewers", ghLines("api", "repos/{owner}/{repo}/collaborators", "--jq", ".[].login"), reviewers)
+	return labels, reviewers
 }
 
-func (g *GitAI) createNewPR(branch, commitMsgs, diff, ticketNumber string) {
+// generatePRTitle generates the title of a new pull request.
+func (g *GitAI) generatePRTitle(branch, commitMsgs, diff, ticketNumber string) (string, error) {
 	logDebug("Generating PR title")
 	prTitleInput := buildInputData(ticketNumber, branch, "", commitMsgs, diff)
-	prTitleAI, err := g.GenerateMessage(embeddedSystemInstructions, embeddedPRTitleFormattingInstructions, prTitleInput)
+	prTitleAI, err := g.GenerateMessage(taskPRTitle, g.systemInstructions(), prTitleInstructions(), prTitleInput)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to generate PR title: %s", err.Error()))
-		return
+		return "", fmt.Errorf("failed to generate PR title: %w", err)
 	}
-	firstLine := strings.SplitN(prTitleAI, "\n", 2)[0]
+	firstLine := stripTitleGitmoji(strings.SplitN(prTitleAI, "\n", 2)[0])
 	if ticketNumber == "NO-TICKET" {
 		firstLine = strings.TrimPrefix(firstLine, "[NO-TICKET] ")
 	}
-	editedTitle, savedTitle := g.editContentInEditor(firstLine)
+	return firstLine, nil
+}
+
+func (g *GitAI) createNewPR(branch, commitMsgs, diff, ticketNumber string, opts PushOptions) error {
+	firstLine, err := g.generatePRTitle(branch, commitMsgs, diff, ticketNumber)
+	if err != nil {
+		return err
+	}
+	editedTitle, savedTitle := g.reviewAIOutput(firstLine)
 	if !savedTitle {
 		logMessage(color.FgYellow, "🚫 PR creation canceled (no save on title).")
-		return
+		return nil
 	}
 	logDebug("Generating PR body")
 	prBodyInput := buildInputData(ticketNumber, branch, editedTitle, commitMsgs, diff)
-	prBodyAI, err := g.GenerateMessage(embeddedSystemInstructions, embeddedPRBodyFormattingInstructions, prBodyInput)
+	prBodyAI, err := g.GenerateMessage(taskPRBody, g.systemInstructions(), g.prBodyInstructions(), prBodyInput)
 	if err != nil {
-		logError(fmt.Sprintf("Failed to generate PR body: %s", err.Error()))
-		return
+		return fmt.Errorf("failed to generate PR body: %w", err)
 	}
-	editedBody, savedBody := g.editContentInEditor(prBodyAI)
+	editedBody, savedBody := g.reviewAIOutput(prBodyAI)
 	if !savedBody {
 		logMessage(color.FgYellow, "🚫 PR creation canceled (no save on body).")
-		return
+		return nil
+	}
+	finalBody := appendPRFooter(editedBody, ticketNumber)
+	if opts.Render && !reviewRenderedBody(finalBody) {
+		logMessage(color.FgYellow, "🚫 PR creation canceled after preview.")
+		return nil
+	}
+	bodyFile, err := writeBodyFile(finalBody)
+	if err != nil {
+		return fmt.Errorf("failed to write PR body: %w", err)
+	}
+	defer os.Remove(bodyFile)
+	createArgs := []string{"pr", "create", "--draft", "--title", editedTitle, "--body-file", bodyFile}
+	if base, mapped := baseBranch(branch); mapped {
+		createArgs = append(createArgs, "--base", base)
+	}
+	labels, reviewers := g.selectPRMeta(opts.InteractiveMeta)
+	for _, label := range labels {
+		createArgs = append(createArgs, "--label", label)
+	}
+	for _, reviewer := range reviewers {
+		createArgs = append(createArgs, "--reviewer", reviewer)
 	}
 	logMessage(color.FgGreen, "🛠️ Creating a draft Pull Request on GitHub...")
-	out, createErr := runCmd("gh", "pr", "create", "--draft", "--title", editedTitle, "--body", editedBody)
+	out, createErr := runCmd("gh", createArgs...)
 	if createErr != nil {
-		logError(fmt.Sprintf("Failed to create PR: %s\nOutput: %s", createErr.Error(), out))
-		return
+		return fmt.Errorf("failed to create PR: %w\nOutput: %s", createErr, out)
 	}
 	logMessage(color.FgGreen, "🎉 Pull Request created successfully!")
+	return nil
 }
 
 var (
@@ -595,12 +4635,19 @@ var (
 	prTitleFormattingInstructions string
 	prBodyFormattingInstructions  string
 	commitFormattingInstructions  string
+	releaseNotesInstructions      string
+	prReviewInstructions          string
+	gitignoreInstructions         string
+	configDir                     string
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "gai",
 	Short: "Git AI Assistant",
 	Long:  "Automate Git operations with AI assistance.",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		activeCommand = strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		_ = cmd.Help()
 	},
@@ -615,42 +4662,216 @@ var versionCmd = &cobra.Command{
 	},
 }
 
-var instructionsCmd = &cobra.Command{
-	Use:     "instructions",
-	Short:   "Displays all loaded instructions",
-	Aliases: []string{"i"},
-	Run: func(cmd *cobra.Command, args []string) {
-		for _, instr := range []struct {
-			color   color.Attribute
-			title   string
-			content string
-		}{
-			{color.BgGreen, "SYSTEM INSTRUCTIONS", systemInstructionsContent},
-			{color.BgBlue, "PULL REQUEST TITLE INSTRUCTIONS", prTitleFormattingInstructions},
-			{color.BgRed, "PULL REQUEST BODY INSTRUCTIONS", prBodyFormattingInstructions},
-			{color.BgYellow, "COMMIT MESSAGE INSTRUCTIONS", commitFormattingInstructions},
-		} {
-			color.New(instr.color).Printf("\n# %s\n%s\n", instr.title, instr.content)
-		}
+var instructionsCmd = &cobra.Command{
+	Use:     "instructions",
+	Short:   "Displays the instructions sent to the model after all overrides are applied",
+	Aliases: []string{"i"},
+	Run: func(cmd *cobra.Command, args []string) {
+		// Resolving the prompts needs git and gh but no OpenAI client
+		g := &GitAI{gitOps: &GitOperations{}}
+		for _, instr := range []struct {
+			color   color.Attribute
+			title   string
+			content string
+		}{
+			{color.BgGreen, "SYSTEM INSTRUCTIONS", g.systemInstructions()},
+			{color.BgBlue, "PULL REQUEST TITLE INSTRUCTIONS", prTitleInstructions()},
+			{color.BgRed, "PULL REQUEST BODY INSTRUCTIONS", g.prBodyInstructions()},
+			{color.BgYellow, "COMMIT MESSAGE INSTRUCTIONS", commitInstructions()},
+			{color.BgCyan, "RELEASE NOTES INSTRUCTIONS", releaseNotesInstructions},
+			{color.BgMagenta, "PULL REQUEST REVIEW INSTRUCTIONS", prReviewInstructions},
+			{color.BgWhite, "GITIGNORE INSTRUCTIONS", gitignoreInstructions},
+		} {
+			color.New(instr.color).Printf("\n# %s\n%s\n", instr.title, instr.content)
+		}
+	},
+}
+
+var commitCmd = &cobra.Command{
+	Use:   "commit [-- git commit flags]",
+	Short: "Generate an AI-powered commit message. Pass additional git commit flags after '--'.",
+	Long: `The commit command generates an AI-powered commit message and allows you to pass additional flags directly to git commit.
+
+Usage:
+  gai commit [flags] [-- git commit flags]
+
+Examples:
+  gai commit -- --amend --force --root
+  gai commit -- -v
+  gai commit --patch-file fix.patch --apply
+  gai commit --grep TODO
+  gai commit --hint "fix race in cache invalidation"
+  gai commit --author "Release Bot <bot@example.com>"
+  gai commit --only src/api --only README.md
+  gai commit --focus
+  gai commit --auto
+  gai commit --candidates 3
+  gai commit --from-log build.log
+  go test ./... 2>&1 | gai commit --from-log -
+
+--grep works at hunk granularity: a hunk with one matching line is staged in full.
+With -- --amend the message describes the whole amended commit, using its current message as context.
+--auto skips the editor like --no-edit, but fails instead of committing when the message breaks a
+commit rule (format, case, gitmoji, COMMIT_MAX_LINES, VALIDATORS). Trailers and sign-off still apply.
+--only replaces the automatic staging: it stages just the pathspec, generates the message from
+its staged diff and commits only those paths. Changes staged elsewhere stay staged.
+`,
+	Aliases: []string{"c"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		args, err := withAuthor(args)
+		if err != nil {
+			logError(err.Error())
+			return err
+		}
+		g := mustNewGitAI()
+		if patchFile, _ := cmd.Flags().GetString("patch-file"); patchFile != "" {
+			apply, _ := cmd.Flags().GetBool("apply")
+			return g.CommitPatch(patchFile, apply, args)
+		}
+		setKeepDate(cmd)
+		var opts CommitOptions
+		opts.Grep, _ = cmd.Flags().GetString("grep")
+		opts.IncludeUnstaged, _ = cmd.Flags().GetBool("include-unstaged")
+		opts.Hint, _ = cmd.Flags().GetString("hint")
+		opts.AllowConflictMarkers, _ = cmd.Flags().GetBool("allow-conflict-markers")
+		opts.Only, _ = cmd.Flags().GetStringArray("only")
+		opts.Auto, _ = cmd.Flags().GetBool("auto")
+		if logPath, _ := cmd.Flags().GetString("from-log"); logPath != "" {
+			if opts.Log, err = readBuildLog(logPath); err != nil {
+				logError(err.Error())
+				return err
+			}
+		}
+		if opts.Auto {
+			viper.Set("GAI_NO_EDIT", true)
+		}
+		if len(opts.Only) > 0 && opts.Grep != "" {
+			err := GitAIException{"--only cannot be combined with --grep"}
+			logError(err.Error())
+			return err
+		}
+		return g.Commit(args, opts)
+	},
+}
+
+// setKeepDate lets a --keep-date flag override AMEND_KEEP_DATE.
+func setKeepDate(cmd *cobra.Command) {
+	if cmd.Flags().Changed("keep-date") {
+		keep, _ := cmd.Flags().GetBool("keep-date")
+		viper.Set("AMEND_KEEP_DATE", keep)
+	}
+}
+
+// streamEvent is one line of the preview --stream-json output.
+type streamEvent struct {
+	Type    string `json:"type"`
+	Text    string `json:"text,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+var previewCmd = &cobra.Command{
+	Use:   "preview",
+	Short: "Print the commit message for the staged changes without committing",
+	Long: `The preview command prints only the generated commit message for the staged changes to stdout.
+It never opens the editor or commits, and all diagnostics go to stderr, so editors and other tools can call it.
+It exits non-zero when nothing is staged.
+
+Examples:
+  gai preview
+  gai preview --model gpt-4o
+  gai preview --stream-json
+
+With --stream-json the output is newline-delimited JSON events:
+  {"type":"token","text":"..."}    for every streamed delta
+  {"type":"done","message":"..."}  with the final message
+  {"type":"error","message":"..."} when generation fails
+`,
+	SilenceUsage: true,
+	Annotations:  map[string]string{"quiet": "true"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cmd.Flags().Changed("model") {
+			model, _ := cmd.Flags().GetString("model")
+			viper.Set("OPENAI_MODEL", model)
+			viper.Set("MODEL_ROUTES", "")
+		}
+		g := mustNewGitAI()
+		if streamJSON, _ := cmd.Flags().GetBool("stream-json"); streamJSON {
+			enc := json.NewEncoder(os.Stdout)
+			message, err := g.Preview(func(text string) {
+				_ = enc.Encode(streamEvent{Type: "token", Text: text})
+			})
+			if err != nil {
+				_ = enc.Encode(streamEvent{Type: "error", Message: err.Error()})
+				return err
+			}
+			return enc.Encode(streamEvent{Type: "done", Message: message})
+		}
+		message, err := g.Preview(nil)
+		if err != nil {
+			logError(err.Error())
+			return err
+		}
+		fmt.Println(message)
+		return nil
+	},
+}
+
+var fixupCmd = &cobra.Command{
+	Use:   "fixup <ref> [-- git commit flags]",
+	Short: "Fold the current changes into a commit and regenerate its message",
+	Long: `The fixup command stages the current changes and folds them into the commit at <ref> with a message regenerated from the combined diff.
+
+When <ref> is HEAD the commit is amended. For an older commit an "amend!" commit is created, to be squashed with git rebase -i --autosquash.
+Commits that are already pushed are refused.
+
+Examples:
+  gai fixup HEAD
+  gai fixup HEAD~2
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		setKeepDate(cmd)
+		g := mustNewGitAI()
+		return g.Fixup(args[0], args[1:])
+	},
+}
+
+var amendCmd = &cobra.Command{
+	Use:   "amend [-- git commit flags]",
+	Short: "Rewrite the message of the last commit with AI",
+	Long: `The amend command regenerates the message of the last commit from its diff and current message and amends it.
+The contents of the commit stay as they are, and staged changes are not included.
+A commit that is already pushed is refused unless --force is passed.
+
+Examples:
+  gai amend
+  gai amend --keep-date
+  gai amend --force
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		setKeepDate(cmd)
+		force, _ := cmd.Flags().GetBool("force")
+		g := mustNewGitAI()
+		return g.Amend(force, args)
 	},
 }
 
-var commitCmd = &cobra.Command{
-	Use:   "commit [-- git commit flags]",
-	Short: "Generate an AI-powered commit message. Pass additional git commit flags after '--'.",
-	Long: `The commit command generates an AI-powered commit message and allows you to pass additional flags directly to git commit.
-
-Usage:
-  gai commit [flags] [-- git commit flags]
+var rewordBranchCmd = &cobra.Command{
+	Use:   "reword-branch",
+	Short: "Regenerate the messages of all commits of the branch with AI",
+	Long: `The reword-branch command regenerates the message of every commit since the branch left origin/<base branch>
+(MAIN_BRANCH, or the BRANCH_BASE_MAP match) from the commit's own diff, shows all new messages and, once confirmed,
+rewrites the branch with git rebase. The contents of the commits stay as they are.
+It refuses to run when origin/<base branch> does not exist, when any of the commits is already pushed, when the branch
+contains merges or the working tree is not clean.
 
 Examples:
-  gai commit -- --amend --force --root
-  gai commit -- -v
+  gai reword-branch
+  gai reword-branch --yes
 `,
-	Aliases: []string{"c"},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		g := mustNewGitAI()
-		return g.Commit(args)
+		return g.RewordBranch()
 	},
 }
 
@@ -665,17 +4886,64 @@ Usage:
 Examples:
   gai push -- --force
   gai push -- --set-upstream origin feature-branch
+  gai push --no-pr
+  gai push --regenerate-section
 `,
 	Aliases: []string{"p"},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		g := mustNewGitAI()
+		var opts PushOptions
+		opts.SkipPR, _ = cmd.Flags().GetBool("no-pr")
+		opts.InteractiveMeta, _ = cmd.Flags().GetBool("interactive-meta")
+		opts.Render, _ = cmd.Flags().GetBool("render")
+		opts.RegenerateSection, _ = cmd.Flags().GetBool("regenerate-section")
 
-		if err := g.CheckRepoPermissions(); err != nil {
-			logError(err.Error())
+		if !opts.SkipPR && hasGH() {
+			noCache, _ := cmd.Flags().GetBool("no-cache")
+			if err := g.CheckRepoPermissions(!noCache); err != nil {
+				logError(err.Error())
+				return err
+			}
+		}
+
+		result, err := g.Push(args, opts)
+		if err != nil {
 			return err
 		}
+		printPushResult(result, opts)
+		noBrowser, _ := cmd.Flags().GetBool("no-browser")
+		if result.Pushed && !opts.SkipPR && hasGH() && viper.GetBool("OPEN_BROWSER") && !noBrowser {
+			g.openPRInBrowser(result.PRNumber)
+		}
+		return nil
+	},
+}
+
+var shipCmd = &cobra.Command{
+	Use:   "ship [-- git push flags]",
+	Short: "Commit, push and create/update the PR in one go",
+	Long: `The ship command runs commit and push back to back: it stages the changes as commit does, commits them with
+an AI-generated message, pushes the branch and creates or updates its pull request.
+With --dry-run it prints the plan instead: whether it would stage, the commit message, the push command and whether
+it would create (with the title) or update a pull request. The AI is asked for the message and title, but nothing is
+staged, committed, pushed or changed on GitHub.
 
-		return g.Push(args)
+Examples:
+  gai ship
+  gai ship --dry-run
+  gai ship -- --force-with-lease
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		g := mustNewGitAI()
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return g.PrintShipPlan(args)
+		}
+		result, err := g.Ship(args)
+		if err != nil {
+			return err
+		}
+		printPushResult(result, PushOptions{})
+		return nil
 	},
 }
 
@@ -698,16 +4966,472 @@ Examples:
 	},
 }
 
+var regenerateCmd = &cobra.Command{
+	Use:   "regenerate [-- git commit flags]",
+	Short: "Generate a new message for the staged changes without staging anything",
+	Long: `The regenerate command re-rolls the commit message for the changes that are already staged and opens the editor again.
+Every run for the same staged changes raises the temperature by REGENERATE_TEMPERATURE_STEP so the output varies.
+
+Examples:
+  gai regenerate
+  gai r -- --no-verify
+`,
+	Aliases: []string{"r"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		g := mustNewGitAI()
+		allowConflictMarkers, _ := cmd.Flags().GetBool("allow-conflict-markers")
+		return g.Regenerate(args, allowConflictMarkers)
+	},
+}
+
+var gitignoreCmd = &cobra.Command{
+	Use:   "gitignore",
+	Short: "Suggest .gitignore entries for untracked files and append them after confirmation",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		g := mustNewGitAI()
+		root, err := g.gitOps.GetRepoRoot()
+		if err != nil {
+			logError("Not inside a git repository")
+			return err
+		}
+		path := filepath.Join(root, ".gitignore")
+		entries, err := g.SuggestGitignore(path)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to suggest .gitignore entries: %s", err.Error()))
+			return err
+		}
+		if len(entries) == 0 {
+			logMessage(color.FgGreen, "✅ Nothing new to ignore.")
+			return nil
+		}
+		logMessage(color.FgCyan, "🙈 Suggested .gitignore entries:")
+		for _, entry := range entries {
+			fmt.Fprintf(os.Stderr, "  %s\n", entry)
+		}
+		if !confirm("Append them to .gitignore?") {
+			logMessage(color.FgYellow, "🚫 .gitignore left unchanged.")
+			return nil
+		}
+		if err := appendGitignore(path, entries); err != nil {
+			logError(fmt.Sprintf("Failed to update .gitignore: %s", err.Error()))
+			return err
+		}
+		logMessage(color.FgGreen, fmt.Sprintf("🙈 Added %d entries to .gitignore.", len(entries)))
+		return nil
+	},
+}
+
+var lintCmd = &cobra.Command{
+	Use:   "lint [ref]",
+	Short: "Validate an existing commit message against the commit rules (default HEAD)",
+	Long: `The lint command checks the message of an existing commit against the same rules
+used by the commit flow and exits non-zero when any rule is broken.
+
+Examples:
+  gai lint
+  gai lint HEAD~1
+`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ref := "HEAD"
+		if len(args) > 0 {
+			ref = args[0]
+		}
+		message, err := (&GitOperations{}).GetCommitMessage(ref)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to read commit message of %s: %s", ref, message))
+			return err
+		}
+		violations := validateCommitMessage(message)
+		if len(violations) == 0 {
+			logMessage(color.FgGreen, fmt.Sprintf("✅ Commit %s follows all rules.", ref))
+			return nil
+		}
+		for _, violation := range violations {
+			logError(violation)
+		}
+		return GitAIException{fmt.Sprintf("commit %s breaks %d rule(s)", ref, len(violations))}
+	},
+}
+
+var changelogCmd = &cobra.Command{
+	Use:   "changelog",
+	Short: "Generate release notes for the changes since the last tag",
+	Long: `The changelog command generates release notes for everything since the last tag.
+
+Examples:
+  gai changelog
+  gai changelog --by-pr
+`,
+	Aliases: []string{"cl"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		g := mustNewGitAI()
+		byPR, _ := cmd.Flags().GetBool("by-pr")
+		notes, err := g.GenerateReleaseNotes(byPR)
+		if err != nil {
+			logError(err.Error())
+			return err
+		}
+		fmt.Println(notes)
+		return nil
+	},
+}
+
+var releaseCmd = &cobra.Command{
+	Use:   "release <version>",
+	Short: "Commit, tag and optionally push a release in one step",
+	Long: `The release command commits the pending changes with an AI-generated 🔖 message and creates an annotated tag with AI-generated release notes.
+The notes cover the commits since the last tag, including the release commit. It refuses when there is nothing to commit
+or the tag already exists.
+
+Examples:
+  gai release v1.2.0
+  gai release v1.2.0 --push
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		g := mustNewGitAI()
+		push, _ := cmd.Flags().GetBool("push")
+		return g.Release(args[0], push)
+	},
+}
+
+var prCmd = &cobra.Command{
+	Use:   "pr",
+	Short: "Pull request helpers",
+}
+
+var prTemplateCmd = &cobra.Command{
+	Use:   "template",
+	Short: "Preview the PR body instructions merged with the repository PR template",
+	Run: func(cmd *cobra.Command, args []string) {
+		g := &GitAI{gitOps: &GitOperations{}}
+		path, _ := g.findPRTemplate()
+		if path == "" {
+			logMessage(color.FgYellow, "ℹ️ No pull request template found. Using plain body instructions.")
+		} else {
+			logMessage(color.FgCyan, fmt.Sprintf("🔍 Using PR template from %s", color.New(color.Bold).Sprint(path)))
+		}
+		color.New(color.BgRed).Printf("\n# PULL REQUEST BODY INSTRUCTIONS\n%s\n", g.prBodyInstructions())
+	},
+}
+
+var prCheckoutCmd = &cobra.Command{
+	Use:   "checkout <number>",
+	Short: "Check out a pull request, optionally printing an AI review summary",
+	Long: `The pr checkout command checks out a pull request with gh.
+
+Examples:
+  gai pr checkout 42
+  gai pr checkout 42 --review
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		review, _ := cmd.Flags().GetBool("review")
+		if !hasGH() {
+			logError("GitHub CLI not found in PATH")
+			return GitAIException{"GitHub CLI not found in PATH"}
+		}
+		g := &GitAI{gitOps: &GitOperations{}}
+		if review {
+			g = mustNewGitAI()
+		}
+		if err := g.CheckoutPR(args[0]); err != nil {
+			logError(err.Error())
+			return err
+		}
+		if !review {
+			return nil
+		}
+		summary, err := g.ReviewPR(args[0])
+		if err != nil {
+			logError(err.Error())
+			return err
+		}
+		fmt.Println(summary)
+		return nil
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration helpers",
+}
+
+var configOpenCmd = &cobra.Command{
+	Use:   "open",
+	Short: "Open the config directory in the system file manager",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := os.MkdirAll(configDir, 0o755); err != nil {
+			logError(fmt.Sprintf("Failed to create config directory: %s", err.Error()))
+			return err
+		}
+		opener := fileOpener()
+		if opener == "" {
+			fmt.Println(configDir)
+			return nil
+		}
+		logMessage(color.FgCyan, fmt.Sprintf("📂 Opening %s...", color.New(color.Bold).Sprint(configDir)))
+		if out, err := runCmd(opener, configDir); err != nil {
+			logError(fmt.Sprintf("Failed to open config directory: %s\nOutput: %s", err.Error(), out))
+			fmt.Println(configDir)
+		}
+		return nil
+	},
+}
+
+// fileOpener returns the platform command opening a path in the file manager,
+// or an empty string on headless systems.
+func fileOpener() string {
+	opener := map[string]string{"darwin": "open", "windows": "explorer"}[runtime.GOOS]
+	if opener == "" {
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return ""
+		}
+		opener = "xdg-open"
+	}
+	if _, err := exec.LookPath(opener); err != nil {
+		return ""
+	}
+	return opener
+}
+
+// promptFiles lists the prompt files that can be customized in the config
+// directory.
+var promptFiles = []string{
+	"systemInstructions.md",
+	"prTitleFormattingInstructions.md",
+	"prBodyFormattingInstructions.md",
+	"commitFormattingInstructions.md",
+	"releaseNotesFormattingInstructions.md",
+	"prReviewInstructions.md",
+	"gitignoreInstructions.md",
+}
+
+func redact(value string) string {
+	if value == "" {
+		return "not set"
+	}
+	return "set (redacted)"
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Summarize generations, tokens and estimated cost from METRICS_FILE",
+	Long: `The stats command summarizes the generations recorded in METRICS_FILE per command.
+
+Examples:
+  gai stats
+  gai stats --since 7d
+  gai stats --since 2024-01-01
+`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := viper.GetString("METRICS_FILE")
+		if path == "" {
+			logMessage(color.FgYellow, "ℹ️ METRICS_FILE is not set. Set it to start recording generations.")
+			return nil
+		}
+		sinceFlag, _ := cmd.Flags().GetString("since")
+		since, err := parseSince(sinceFlag)
+		if err != nil {
+			logError(err.Error())
+			return err
+		}
+		records, err := readMetrics(path)
+		if os.IsNotExist(err) {
+			logMessage(color.FgYellow, fmt.Sprintf("ℹ️ No metrics recorded yet in %s.", path))
+			return nil
+		}
+		if err != nil {
+			logError(fmt.Sprintf("Failed to read %s: %s", path, err.Error()))
+			return err
+		}
+
+		type usage struct {
+			generations, failures, promptTokens, completionTokens int
+			cost                                                  float64
+		}
+		byCommand := map[string]*usage{}
+		var commands []string
+		var total usage
+		unpriced := false
+		for _, record := range records {
+			if record.Timestamp.Before(since) {
+				continue
+			}
+			name := record.Command
+			if name == "" {
+				name = "(unknown)"
+			}
+			u, ok := byCommand[name]
+			if !ok {
+				u = &usage{}
+				byCommand[name] = u
+				commands = append(commands, name)
+			}
+			cost, priced := estimateCost(record)
+			unpriced = unpriced || !priced
+			for _, x := range []*usage{u, &total} {
+				x.generations++
+				if !record.Success {
+					x.failures++
+				}
+				x.promptTokens += record.PromptTokens
+				x.completionTokens += record.CompletionTokens
+				x.cost += cost
+			}
+		}
+		if total.generations == 0 {
+			logMessage(color.FgYellow, "ℹ️ No generations in the selected range.")
+			return nil
+		}
+		sort.Strings(commands)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "COMMAND\tGENERATIONS\tFAILED\tPROMPT TOKENS\tCOMPLETION TOKENS\tEST. COST\t")
+		for _, name := range commands {
+			u := byCommand[name]
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t$%.4f\t\n", name, u.generations, u.failures, u.promptTokens, u.completionTokens, u.cost)
+		}
+		fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\t%d\t$%.4f\t\n", total.generations, total.failures, total.promptTokens, total.completionTokens, total.cost)
+		w.Flush()
+		if unpriced {
+			logMessage(color.FgYellow, "⚠️ Some models have no known price and are left out of the cost estimate.")
+		}
+		return nil
+	},
+}
+
+var modelsCmd = &cobra.Command{
+	Use:   "models",
+	Short: "List the models of the configured provider",
+	Long: `The models command lists the models available at the provider endpoint and marks the configured one.
+The list is cached per endpoint for MODELS_CACHE_TTL.
+
+Examples:
+  gai models
+  gai models --refresh-models
+`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		provider, err := newProvider()
+		if err != nil {
+			logError(err.Error())
+			return err
+		}
+		refresh, _ := cmd.Flags().GetBool("refresh-models")
+		models, err := listModels(provider, refresh)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to list models: %s", err.Error()))
+			return err
+		}
+		configured := configuredModel()
+		found := false
+		for _, model := range models {
+			// Ollama lists untagged models with the implicit :latest tag
+			if model == configured || model == configured+":latest" {
+				found = true
+				fmt.Printf("* %s\n", model)
+				continue
+			}
+			fmt.Printf("  %s\n", model)
+		}
+		if !found {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ The configured model %s is not offered by %s", configured, providerEndpoint()))
+		}
+		return nil
+	},
+}
+
+var whatamiCmd = &cobra.Command{
+	Use:   "whatami",
+	Short: "Print the resolved environment for bug reports",
+	Run: func(cmd *cobra.Command, args []string) {
+		gitVersion, _ := runCmd("git", "--version")
+		ghVersion := "not installed"
+		if hasGH() {
+			out, _ := runCmd("gh", "--version")
+			ghVersion = strings.SplitN(out, "\n", 2)[0]
+		}
+		fmt.Printf("gai version:      %s\n", Version)
+		fmt.Printf("os/arch:          %s/%s\n", runtime.GOOS, runtime.GOARCH)
+		fmt.Printf("git:              %s\n", gitVersion)
+		fmt.Printf("gh:               %s\n", ghVersion)
+		fmt.Printf("provider:         %s\n", viper.GetString("GAI_PROVIDER"))
+		fmt.Printf("model:            %s\n", configuredModel())
+		fmt.Printf("OPENAI_API_KEY:   %s\n", redact(viper.GetString("OPENAI_API_KEY")))
+		fmt.Printf("ANTHROPIC_API_KEY: %s\n", redact(viper.GetString("ANTHROPIC_API_KEY")))
+		fmt.Printf("config dir:       %s\n", configDir)
+		fmt.Println("prompt files:")
+		for _, name := range promptFiles {
+			source := "default"
+			if _, err := os.Stat(filepath.Join(configDir, name)); err == nil {
+				source = "custom"
+			}
+			fmt.Printf("  %-40s %s\n", name, source)
+		}
+	},
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().BoolP("verbose", "V", false, "Enable verbose output")
 	_ = viper.BindPFlag("VERBOSE", rootCmd.PersistentFlags().Lookup("verbose"))
-	rootCmd.AddCommand(versionCmd, instructionsCmd, commitCmd, pushCmd, stashCmd)
+	rootCmd.PersistentFlags().BoolP("yes", "y", false, "Answer yes to confirmation prompts")
+	_ = viper.BindPFlag("ASSUME_YES", rootCmd.PersistentFlags().Lookup("yes"))
+	rootCmd.PersistentFlags().Duration("timeout", 60*time.Second, "Give up on an AI request after this long (0 disables)")
+	_ = viper.BindPFlag("GAI_TIMEOUT", rootCmd.PersistentFlags().Lookup("timeout"))
+	rootCmd.PersistentFlags().Bool("no-edit", false, "Accept AI-generated messages without opening the editor")
+	_ = viper.BindPFlag("GAI_NO_EDIT", rootCmd.PersistentFlags().Lookup("no-edit"))
+	prCmd.AddCommand(prTemplateCmd, prCheckoutCmd)
+	configCmd.AddCommand(configOpenCmd)
+	prCheckoutCmd.Flags().Bool("review", false, "Print an AI summary of the pull request after checkout")
+	shipCmd.Flags().Bool("dry-run", false, "Print the plan without staging, committing, pushing or changing the pull request")
+	releaseCmd.Flags().Bool("push", false, "Push the branch and the tag to origin")
+	modelsCmd.Flags().Bool("refresh-models", false, "Fetch the model list again instead of using the cache")
+	statsCmd.Flags().String("since", "", "Only count generations since a date (2006-01-02), a duration (12h) or days (7d)")
+	changelogCmd.Flags().Bool("by-pr", false, "Group release notes by merged pull requests instead of commits")
+	commitCmd.Flags().BoolP("signoff", "s", false, "Add a Signed-off-by trailer to the commit message")
+	_ = viper.BindPFlag("COMMIT_SIGNOFF", commitCmd.Flags().Lookup("signoff"))
+	commitCmd.Flags().String("author", "", "Commit on behalf of another identity, as \"Name <email>\"")
+	_ = viper.BindPFlag("AUTHOR", commitCmd.Flags().Lookup("author"))
+	commitCmd.Flags().Bool("keep-date", false, "Keep the original author date when amending (-- --amend)")
+	fixupCmd.Flags().Bool("keep-date", false, "Keep the original author date when amending HEAD")
+	amendCmd.Flags().Bool("force", false, "Rewrite the last commit even when it is already pushed")
+	amendCmd.Flags().Bool("keep-date", false, "Keep the original author date")
+	commitCmd.Flags().Bool("exclude-tests", false, "Leave test files (TEST_PATTERNS) out of the AI input; they are still committed")
+	_ = viper.BindPFlag("EXCLUDE_TESTS", commitCmd.Flags().Lookup("exclude-tests"))
+	commitCmd.Flags().Bool("allow-conflict-markers", false, "Commit even when staged changes add conflict markers")
+	regenerateCmd.Flags().Bool("allow-conflict-markers", false, "Commit even when staged changes add conflict markers")
+	commitCmd.Flags().String("from-log", "", "Build or CI log file (- for stdin) the change fixes, given to the model as context")
+	commitCmd.Flags().Int("candidates", 1, "Generate this many candidate messages and pick one before editing")
+	_ = viper.BindPFlag("COMMIT_CANDIDATES", commitCmd.Flags().Lookup("candidates"))
+	commitCmd.Flags().Bool("offline-fallback", false, "When the AI request fails, build a plain message from the diff stat instead of aborting")
+	_ = viper.BindPFlag("OFFLINE_FALLBACK", commitCmd.Flags().Lookup("offline-fallback"))
+	commitCmd.Flags().Bool("auto", false, "Commit the AI message without the editor, but fail when it breaks a commit rule")
+	commitCmd.Flags().Bool("focus", false, "Lead the subject with the single most impactful change and list the rest in the body")
+	_ = viper.BindPFlag("COMMIT_FOCUS", commitCmd.Flags().Lookup("focus"))
+	commitCmd.Flags().String("hint", "", "Short description of the intent of the change to steer the message")
+	commitCmd.Flags().Bool("include-unstaged", false, "Send unstaged changes to the model as context (they are not committed)")
+	commitCmd.Flags().String("grep", "", "Stage and commit only the hunks whose changed lines match the regex")
+	commitCmd.Flags().StringArray("only", nil, "Stage, describe and commit only this pathspec (repeatable)")
+	commitCmd.Flags().String("patch-file", "", "Generate the commit message from a unified diff file")
+	commitCmd.Flags().Bool("apply", false, "Apply the --patch-file and commit it instead of printing the message")
+	previewCmd.Flags().Bool("stream-json", false, "Stream newline-delimited JSON events to stdout")
+	previewCmd.Flags().String("model", "", "Model to use instead of OPENAI_MODEL and MODEL_ROUTES")
+	pushCmd.Flags().Bool("no-pr", false, "Only push the branch, skip creating or updating a pull request")
+	pushCmd.Flags().Bool("no-browser", false, "Print the pull request URL instead of opening it in the browser")
+	pushCmd.Flags().Bool("no-cache", false, "Check repository permissions without using the cache")
+	pushCmd.Flags().Bool("render", false, "Preview the PR body as rendered markdown and confirm before sending it")
+	pushCmd.Flags().Bool("regenerate-section", false, "Rewrite one picked section of the existing PR body and keep the rest")
+	pushCmd.Flags().Bool("interactive-meta", false, "Interactively pick labels and reviewers for a new pull request")
+	rootCmd.AddCommand(versionCmd, instructionsCmd, commitCmd, regenerateCmd, previewCmd, amendCmd, rewordBranchCmd, fixupCmd, pushCmd, shipCmd, stashCmd, gitignoreCmd, lintCmd, changelogCmd, releaseCmd, prCmd, configCmd, modelsCmd, statsCmd, whatamiCmd)
 }
 
 func initConfig() {
 	viper.AutomaticEnv()
-	configDir := viper.GetString("GAI_CONFIG_DIR")
+	configDir = viper.GetString("GAI_CONFIG_DIR")
 	if configDir == "" {
 		configDir = os.Getenv("XDG_CONFIG_HOME")
 		if configDir == "" {
@@ -720,13 +5444,64 @@ func initConfig() {
 	prTitleFormattingInstructions = loadPrompt(filepath.Join(configDir, "prTitleFormattingInstructions.md"), embeddedPRTitleFormattingInstructions)
 	prBodyFormattingInstructions = loadPrompt(filepath.Join(configDir, "prBodyFormattingInstructions.md"), embeddedPRBodyFormattingInstructions)
 	commitFormattingInstructions = loadPrompt(filepath.Join(configDir, "commitFormattingInstructions.md"), embeddedCommitFormattingInstructions)
+	releaseNotesInstructions = loadPrompt(filepath.Join(configDir, "releaseNotesFormattingInstructions.md"), embeddedReleaseNotesFormattingInstructions)
+	prReviewInstructions = loadPrompt(filepath.Join(configDir, "prReviewInstructions.md"), embeddedPRReviewInstructions)
+	gitignoreInstructions = loadPrompt(filepath.Join(configDir, "gitignoreInstructions.md"), embeddedGitignoreInstructions)
 
-	viper.SetDefault("OPENAI_MODEL", "gpt-4o-mini")
+	viper.SetDefault("GAI_PROVIDER", "openai")
+	viper.SetDefault("ANTHROPIC_BASE_URL", "https://api.anthropic.com")
+	viper.SetDefault("GAI_OLLAMA_HOST", "http://localhost:11434")
 	viper.SetDefault("OPENAI_MAX_TOKENS", 16384)
 	viper.SetDefault("OPENAI_TEMPERATURE", 0.0)
 	viper.SetDefault("OPENAI_TOP_P", 1.0)
+	viper.SetDefault("OPENAI_FREQUENCY_PENALTY", 0.0)
+	viper.SetDefault("OPENAI_PRESENCE_PENALTY", 0.0)
 	viper.SetDefault("MAIN_BRANCH", "main")
+	viper.SetDefault("COMPACT_DIFF", false)
+	viper.SetDefault("PR_FILTER_FIXUP", true)
+	viper.SetDefault("PR_TITLE_CONVENTIONAL", false)
+	viper.SetDefault("PR_TITLE_GITMOJI", "inherit")
+	viper.SetDefault("PR_EMPTY_SECTIONS", "omit")
+	viper.SetDefault("OPEN_BROWSER", true)
+	viper.SetDefault("TICKET_PATTERNS", `[A-Z]+-\d+`)
+	viper.SetDefault("COMMIT_SUBJECT_CASE", "any")
+	viper.SetDefault("COMMIT_FOCUS", false)
+	viper.SetDefault("REGENERATE_TEMPERATURE_STEP", 0.2)
+	viper.SetDefault("INFER_ISSUE", false)
+	viper.SetDefault("LOG_MAX_CHARS", 8000)
+	viper.SetDefault("GITMOJI_TYPE_MAP", defaultGitmojiTypeMap)
+	viper.SetDefault("GITMOJI_TYPE_MISMATCH", "emoji")
+	viper.SetDefault("COMMIT_SCOPE_FROM_PATH", false)
+	viper.SetDefault("OFFLINE_FALLBACK", false)
+	viper.SetDefault("COMMIT_CANDIDATES", 1)
+	viper.SetDefault("EDIT_ON_INVALID_ONLY", false)
+	viper.SetDefault("COMMIT_WITH_BODY", false)
+	viper.SetDefault("COMMIT_BODY_STYLE", "prose")
+	viper.SetDefault("COMMIT_MOOD", "imperative")
+	viper.SetDefault("COMMIT_SIGNOFF", false)
+	viper.SetDefault("COMMIT_SIGN", false)
+	viper.SetDefault("COMMIT_SEPARATE_BODY", false)
+	viper.SetDefault("SLOW_WARNING_SECONDS", 15)
+	viper.SetDefault("GAI_DISABLE_AI", false)
+	viper.SetDefault("ABORT_ON_EDITOR_ERROR", false)
+	viper.SetDefault("MIXED_CHANGES", "warn")
+	viper.SetDefault("PR_STYLE_SAMPLE_COUNT", 0)
+	viper.SetDefault("COMMIT_MAX_LINES", 0)
+	viper.SetDefault("AMEND_KEEP_DATE", false)
+	viper.SetDefault("NO_MERGES", true)
+	viper.SetDefault("EXCLUDE_TESTS", false)
+	viper.SetDefault("PRIVACY_WARN_BYTES", 0)
+	viper.SetDefault("DIFF_STAT_MAX_LINES", 20)
+	viper.SetDefault("TEST_PATTERNS", "*_test.go,*.test.js,test/,spec/")
+	viper.SetDefault("GIT_BINARY", "git")
+	viper.SetDefault("GH_BINARY", "gh")
+	viper.SetDefault("PERMISSION_CACHE_TTL", time.Hour)
+	viper.SetDefault("MODELS_CACHE_TTL", 24*time.Hour)
 	viper.SetDefault("VERBOSE", false)
+	viper.SetDefault("GAI_NO_EDIT", false)
+	viper.SetDefault("ASSUME_YES", false)
+	viper.SetDefault("GAI_TIMEOUT", 60*time.Second)
+	viper.SetDefault("GAI_STREAM", false)
 }
 
 func loadPrompt(path, defaultContent string) string {
@@ -743,31 +5518,245 @@ func loadPrompt(path, defaultContent string) string {
 	return string(data)
 }
 
+// opSecrets caches secrets resolved through 1Password for the lifetime of the
+// process. They are never written to disk.
+var opSecrets = map[string]string{}
+
+// resolveOPSecret reads a secret reference such as op://vault/item/field with
+// the 1Password CLI.
+func resolveOPSecret(reference string) (string, error) {
+	if secret, ok := opSecrets[reference]; ok {
+		return secret, nil
+	}
+	if _, err := exec.LookPath("op"); err != nil {
+		return "", GitAIException{"1Password CLI (op) not found in PATH, cannot resolve OP_SECRET_REFERENCE"}
+	}
+	logDebug(fmt.Sprintf("Resolving %s with op read", reference))
+	out, err := exec.Command("op", "read", "--no-newline", reference).Output()
+	if err != nil {
+		return "", GitAIException{fmt.Sprintf("Cannot read %s with 1Password CLI: %s", reference, err.Error())}
+	}
+	opSecrets[reference] = string(out)
+	return opSecrets[reference], nil
+}
+
 func mustNewGitAI() *GitAI {
-	apiKey := viper.GetString("OPENAI_API_KEY")
-	if apiKey == "" {
-		logError("OPENAI_API_KEY environment variable not set")
+	if viper.GetBool("GAI_DISABLE_AI") {
+		logError("AI generation is disabled (GAI_DISABLE_AI is set). No API calls will be made.")
+		os.Exit(1)
+	}
+	provider, err := newProvider()
+	if err != nil {
+		logError(err.Error())
 		os.Exit(1)
 	}
-	client := openai.NewClient(apiKey)
 
 	if err := checkRequirements(); err != nil {
 		logError(err.Error())
 		os.Exit(1)
 	}
+	gitOps := &GitOperations{}
 	return &GitAI{
-		gitOps:       &GitOperations{},
-		openAIClient: client,
+		gitOps:   gitOps,
+		provider: provider,
+		pushGit:  gitOps,
+		forge:    ghForge{},
+	}
+}
+
+// newProvider builds the Provider selected by GAI_PROVIDER, failing when its
+// API key is missing.
+func newProvider() (Provider, error) {
+	switch provider := viper.GetString("GAI_PROVIDER"); provider {
+	case "openai":
+		apiKey, mapped, err := mappedAPIKey()
+		if err != nil {
+			return nil, err
+		}
+		if !mapped {
+			apiKey = viper.GetString("OPENAI_API_KEY")
+		}
+		if apiKey == "" && !mapped && viper.GetString("OP_SECRET_REFERENCE") != "" {
+			key, err := resolveOPSecret(viper.GetString("OP_SECRET_REFERENCE"))
+			if err != nil {
+				logError(err.Error())
+			}
+			apiKey = key
+		}
+		if apiKey == "" {
+			return nil, GitAIException{"OPENAI_API_KEY environment variable not set"}
+		}
+		config := openai.DefaultConfig(apiKey)
+		if baseURL := viper.GetString("OPENAI_BASE_URL"); baseURL != "" {
+			config.BaseURL = baseURL
+		}
+		return &openAIProvider{client: openai.NewClientWithConfig(config)}, nil
+	case "anthropic":
+		apiKey, mapped, err := mappedAPIKey()
+		if err != nil {
+			return nil, err
+		}
+		if !mapped {
+			apiKey = viper.GetString("ANTHROPIC_API_KEY")
+		}
+		if apiKey == "" {
+			return nil, GitAIException{"ANTHROPIC_API_KEY environment variable not set (required by GAI_PROVIDER=anthropic)"}
+		}
+		return &anthropicProvider{apiKey: apiKey, baseURL: viper.GetString("ANTHROPIC_BASE_URL")}, nil
+	case "ollama":
+		return &ollamaProvider{host: viper.GetString("GAI_OLLAMA_HOST")}, nil
+	default:
+		return nil, GitAIException{fmt.Sprintf("Unsupported GAI_PROVIDER %q, use openai, anthropic or ollama", provider)}
+	}
+}
+
+// mappedAPIKey resolves the API key of the first KEY_MAP entry
+// ("github.com/acme/=ACME_OPENAI_KEY,github.com/me/=!pass show openai") whose
+// regex matches the origin remote URL. The value is the name of an environment
+// variable, or a command run with sh -c when it starts with "!". It reports
+// whether an entry matched so the caller can fall back to the default key.
+func mappedAPIKey() (string, bool, error) {
+	entries := splitList(viper.GetString("KEY_MAP"))
+	if len(entries) == 0 {
+		return "", false, nil
+	}
+	remote, _ := runCmd("git", "remote", "get-url", "origin")
+	for _, entry := range entries {
+		pattern, source, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			logMessage(color.FgYellow, fmt.Sprintf("⚠️ Ignoring invalid KEY_MAP pattern %q: %s", pattern, err.Error()))
+			continue
+		}
+		if remote == "" || !re.MatchString(remote) {
+			continue
+		}
+		source = strings.TrimSpace(source)
+		if command, ok := strings.CutPrefix(source, "!"); ok {
+			logDebug(fmt.Sprintf("Reading the API key for %s from a KEY_MAP command", remote))
+			out, err := exec.Command("sh", "-c", command).Output()
+			if err != nil {
+				return "", true, GitAIException{fmt.Sprintf("KEY_MAP command for %s failed: %s", remote, err.Error())}
+			}
+			return strings.TrimSpace(string(out)), true, nil
+		}
+		logDebug(fmt.Sprintf("Using the API key in %s for %s (KEY_MAP)", source, remote))
+		key := os.Getenv(source)
+		if key == "" {
+			return "", true, GitAIException{fmt.Sprintf("%s is not set, but KEY_MAP selects it for %s", source, remote)}
+		}
+		return key, true, nil
+	}
+	return "", false, nil
+}
+
+// providerEndpoint returns the API base URL of the selected provider.
+func providerEndpoint() string {
+	switch viper.GetString("GAI_PROVIDER") {
+	case "anthropic":
+		return viper.GetString("ANTHROPIC_BASE_URL")
+	case "ollama":
+		return viper.GetString("GAI_OLLAMA_HOST")
+	}
+	if baseURL := viper.GetString("OPENAI_BASE_URL"); baseURL != "" {
+		return baseURL
 	}
+	return openai.DefaultConfig("").BaseURL
+}
+
+// modelsCacheEntry is the cached model list of one provider endpoint.
+type modelsCacheEntry struct {
+	Endpoint  string    `json:"endpoint"`
+	Models    []string  `json:"models"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// modelsCachePath returns the cache file of the endpoint, keyed by a hash of
+// the provider and its base URL so switching endpoints never mixes lists.
+func modelsCachePath(endpoint string) string {
+	sum := sha256.Sum256([]byte(viper.GetString("GAI_PROVIDER") + "|" + endpoint))
+	return filepath.Join(configDir, "cache", fmt.Sprintf("models-%s.json", hex.EncodeToString(sum[:8])))
+}
+
+// listModels returns the models of the provider endpoint, served from the
+// cache while it is younger than MODELS_CACHE_TTL unless refresh is set. A
+// corrupt cache file is refetched.
+func listModels(provider Provider, refresh bool) ([]string, error) {
+	lister, ok := provider.(interface {
+		ListModels(ctx context.Context) ([]string, error)
+	})
+	if !ok {
+		return nil, GitAIException{fmt.Sprintf("GAI_PROVIDER %s cannot list models", viper.GetString("GAI_PROVIDER"))}
+	}
+	endpoint := providerEndpoint()
+	path := modelsCachePath(endpoint)
+	if data, err := os.ReadFile(path); err == nil && !refresh {
+		var entry modelsCacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Endpoint != endpoint {
+			logDebug(fmt.Sprintf("Ignoring corrupt models cache %s", path))
+		} else if time.Since(entry.FetchedAt) < viper.GetDuration("MODELS_CACHE_TTL") {
+			logDebug(fmt.Sprintf("Using cached models of %s from %s", endpoint, entry.FetchedAt.Format(time.RFC3339)))
+			return entry.Models, nil
+		}
+	}
+	logDebug(fmt.Sprintf("Fetching models from %s", endpoint))
+	models, err := lister.ListModels(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(models)
+	data, _ := json.MarshalIndent(modelsCacheEntry{Endpoint: endpoint, Models: models, FetchedAt: time.Now()}, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		logDebug(fmt.Sprintf("Cannot create cache directory: %s", err.Error()))
+		return models, nil
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		logDebug(fmt.Sprintf("Cannot write models cache: %s", err.Error()))
+	}
+	return models, nil
+}
+
+func hasGH() bool {
+	_, err := exec.LookPath(binaryPath("gh"))
+	return err == nil
+}
+
+// githubRemoteRe captures the host and owner/repo path of SSH and HTTPS remotes.
+// The host is in the first group for URLs with a scheme, which may carry a
+// port, and in the second one for scp-like remotes.
+var githubRemoteRe = regexp.MustCompile(`^(?:[a-z+]+://(?:[^@/]+@)?([^:/]+)(?::\d+)?/|(?:[^@/]+@)?([^:/]+)[:/])(.+?)(?:\.git)?/?$`)
+
+// remoteWebURL returns the web URL of the origin remote, e.g.
+// git@github.com:owner/repo.git becomes https://github.com/owner/repo.
+func remoteWebURL() (string, error) {
+	out, err := (&GitOperations{}).RemoteURL("origin")
+	if err != nil {
+		return "", err
+	}
+	return webURLFromRemote(out)
+}
+
+// webURLFromRemote turns a remote URL into the web URL of the repository.
+func webURLFromRemote(remoteURL string) (string, error) {
+	m := githubRemoteRe.FindStringSubmatch(remoteURL)
+	if m == nil {
+		return "", fmt.Errorf("cannot parse remote URL %q", remoteURL)
+	}
+	return fmt.Sprintf("https://%s/%s", m[1]+m[2], m[3]), nil
 }
 
 func checkRequirements() error {
 	logMessage(color.FgCyan, "🔎 Checking system requirements...")
-	if _, err := exec.LookPath("git"); err != nil {
-		return GitAIException{"Git not found in PATH"}
+	if _, err := exec.LookPath(binaryPath("git")); err != nil {
+		return GitAIException{fmt.Sprintf("Git not found (%s)", binaryPath("git"))}
 	}
-	if _, err := exec.LookPath("gh"); err != nil {
-		return GitAIException{"GitHub CLI not found in PATH"}
+	if !hasGH() {
+		logMessage(color.FgYellow, "⚠️ GitHub CLI not found in PATH. Pull requests will have to be opened manually.")
+		logMessage(color.FgGreen, "✅ All requirements satisfied!")
+		return nil
 	}
 	out, err := runCmd("gh", "auth", "status")
 	if err != nil {
@@ -802,10 +5791,24 @@ func checkRepoPermissions() error {
 	}
 }
 
+func showBanner() bool {
+	if !isatty.IsTerminal(os.Stdout.Fd()) {
+		return false
+	}
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	return err != nil || cmd.Annotations["quiet"] != "true"
+}
+
 func main() {
-	color.New(color.FgMagenta).Printf("%s\n", ASCIIHeader)
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+	// The banner is skipped when stdout is piped and for commands whose stdout
+	// is consumed by tools
+	if showBanner() {
+		color.New(color.FgMagenta).Printf("%s\n", ASCIIHeader)
+	}
+	err := rootCmd.Execute()
+	metricsWG.Wait()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gai-test-config-*")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("GAI_CONFIG_DIR", dir)
+	initConfig()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setConfig overrides a config key for the duration of the test.
+func setConfig(t *testing.T, key string, value any) {
+	t.Helper()
+	previous := viper.Get(key)
+	viper.Set(key, value)
+	t.Cleanup(func() { viper.Set(key, previous) })
+}
+
+func TestSubjectCase(t *testing.T) {
+	tests := []struct {
+		mode, message, fixed string
+		valid                bool
+	}{
+		{"lower", "✨ feat: Add login", "✨ feat: add login", false},
+		{"lower", "✨ feat: add login", "✨ feat: add login", true},
+		{"lower", "✨ feat: API keys", "✨ feat: API keys", true},
+		{"sentence", "🐛 fix(auth): reject empty tokens", "🐛 fix(auth): Reject empty tokens", false},
+		{"sentence", "🐛 fix(auth): Reject empty tokens", "🐛 fix(auth): Reject empty tokens", true},
+		{"any", "📝 docs: Explain setup", "📝 docs: Explain setup", true},
+		{"any", "📝 docs: explain setup", "📝 docs: explain setup", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"/"+tt.message, func(t *testing.T) {
+			setConfig(t, "COMMIT_SUBJECT_CASE", tt.mode)
+			m := commitSubjectRe.FindStringSubmatch(tt.message)
+			if m == nil {
+				t.Fatalf("subject %q does not match commitSubjectRe", tt.message)
+			}
+			if got := m[1] + applySubjectCase(m[2]); got != tt.fixed {
+				t.Errorf("applySubjectCase = %q, want %q", got, tt.fixed)
+			}
+			violations := validateCommitMessage(tt.message)
+			if valid := len(violations) == 0; valid != tt.valid {
+				t.Errorf("validateCommitMessage = %v, want valid %v", violations, tt.valid)
+			}
+		})
+	}
+}
+
+// initRepo creates an empty git repository in a temporary directory and
+// changes into it for the duration of the test.
+func initRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, key := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(key, "gai")
+	}
+	for _, key := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(key, "gai@example.com")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	git(t, "init", "--quiet")
+	return dir
+}
+
+// git runs a git command in the current directory and fails the test when it
+// fails.
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestHasCommits(t *testing.T) {
+	initRepo(t)
+	gitOps := &GitOperations{}
+	if gitOps.HasCommits() {
+		t.Fatal("HasCommits = true in an empty repository")
+	}
+	git(t, "commit", "--quiet", "--allow-empty", "-m", "initial")
+	if !gitOps.HasCommits() {
+		t.Fatal("HasCommits = false after the first commit")
+	}
+}
+
+func TestCommitContextFirstCommit(t *testing.T) {
+	initRepo(t)
+	if err := os.WriteFile("README.md", []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "README.md")
+	g := &GitAI{gitOps: &GitOperations{}}
+	if !strings.Contains(strings.Join(g.commitContext(CommitOptions{}), "\n"), "first commit of the repository") {
+		t.Error("commitContext does not mention the first commit in an empty repository")
+	}
+	git(t, "commit", "--quiet", "-m", "initial")
+	if err := os.WriteFile("README.md", []byte("hello again\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "README.md")
+	if strings.Contains(strings.Join(g.commitContext(CommitOptions{}), "\n"), "first commit of the repository") {
+		t.Error("commitContext mentions the first commit in a repository with commits")
+	}
+}
+
+func TestGetCommitMessage(t *testing.T) {
+	initRepo(t)
+	gitOps := &GitOperations{}
+	if _, err := gitOps.GetCommitMessage("HEAD"); err == nil {
+		t.Error("GetCommitMessage(HEAD) succeeded in an empty repository")
+	}
+	git(t, "commit", "--quiet", "--allow-empty", "-m", "🎉 chore: initial commit")
+	git(t, "commit", "--quiet", "--allow-empty", "-m", "✨ feat: add login", "-m", "Users can log in with a password.")
+	tests := map[string]string{
+		"HEAD":   "✨ feat: add login\n\nUsers can log in with a password.",
+		"HEAD~1": "🎉 chore: initial commit",
+	}
+	for ref, want := range tests {
+		got, err := gitOps.GetCommitMessage(ref)
+		if err != nil || got != want {
+			t.Errorf("GetCommitMessage(%s) = %q, %v, want %q", ref, got, err, want)
+		}
+	}
+}
+
+func TestParseSections(t *testing.T) {
+	body := "Intro\n## Summary\n#123 fixes the crash\n####### not a heading\n### Testing\nRan it\n#\n"
+	var headings []string
+	for _, section := range parseSections(body) {
+		headings = append(headings, section.heading)
+	}
+	want := []string{"", "## Summary", "### Testing", "#"}
+	if strings.Join(headings, "|") != strings.Join(want, "|") {
+		t.Errorf("headings = %q, want %q", headings, want)
+	}
+	if got := renderSections(parseSections(body)); got != strings.TrimSpace(body) {
+		t.Errorf("renderSections(parseSections(body)) = %q, want the body unchanged", got)
+	}
+}
+
+// fakePushGit is a PushGit that records pushes instead of running git.
+type fakePushGit struct {
+	hasCommits bool
+	pushed     bool
+	remoteURL  string
+	pushes     []string
+}
+
+func (f *fakePushGit) GetCurrentBranch() (string, error)             { return "feature/login", nil }
+func (f *fakePushGit) HasCommitsToPush(string, string) (bool, error) { return f.hasCommits, nil }
+func (f *fakePushGit) IsPushed() bool                                { return f.pushed }
+func (f *fakePushGit) RemoteBranchExists(string, string) bool        { return false }
+func (f *fakePushGit) Fetch(string, string) error                    { return nil }
+func (f *fakePushGit) Push(branch, remote string, _ []string) error {
+	f.pushes = append(f.pushes, remote+"/"+branch)
+	return nil
+}
+func (f *fakePushGit) RemoteURL(string) (string, error)                 { return f.remoteURL, nil }
+func (f *fakePushGit) RefExists(string) bool                            { return false }
+func (f *fakePushGit) AheadBehind(string, string) (int, int, error)     { return 0, 0, nil }
+func (f *fakePushGit) CountMerges(string) (int, error)                  { return 0, nil }
+func (f *fakePushGit) GetCommitMessages(string, string) (string, error) { return "", nil }
+func (f *fakePushGit) GetDiff(bool) (string, error)                     { return "", nil }
+
+// fakeForge is a Forge with a fixed availability and lookup result.
+type fakeForge struct {
+	available bool
+	findErr   error
+}
+
+func (f fakeForge) Available() bool               { return f.available }
+func (f fakeForge) FindPR(string) (string, error) { return "", f.findErr }
+func (f fakeForge) PRURL(number string) string    { return "https://github.com/o/r/pull/" + number }
+
+func TestPush(t *testing.T) {
+	setConfig(t, "MAIN_BRANCH", "main")
+	tests := []struct {
+		name       string
+		git        fakePushGit
+		forge      fakeForge
+		opts       PushOptions
+		wantPushes int
+		want       PushResult
+		wantErr    bool
+	}{
+		{
+			name: "nothing to push",
+			want: PushResult{Branch: "feature/login"},
+		},
+		{
+			name: "already pushed without PR",
+			git:  fakePushGit{hasCommits: true, pushed: true},
+			opts: PushOptions{SkipPR: true},
+			want: PushResult{Branch: "feature/login", Pushed: true},
+		},
+		{
+			name:       "compare URL without forge",
+			git:        fakePushGit{hasCommits: true, remoteURL: "git@github.com:o/r.git"},
+			wantPushes: 1,
+			want:       PushResult{Branch: "feature/login", Pushed: true, PRURL: "https://github.com/o/r/compare/main...feature/login?expand=1"},
+		},
+		{
+			name:       "forge lookup fails",
+			git:        fakePushGit{hasCommits: true},
+			forge:      fakeForge{available: true, findErr: errors.New("gh failed")},
+			wantPushes: 1,
+			want:       PushResult{Branch: "feature/login", Pushed: true},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GitAI{pushGit: &tt.git, forge: tt.forge}
+			result, err := g.Push(nil, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Push error = %v, want error %v", err, tt.wantErr)
+			}
+			if result != tt.want {
+				t.Errorf("Push = %+v, want %+v", result, tt.want)
+			}
+			if len(tt.git.pushes) != tt.wantPushes {
+				t.Errorf("pushed %v, want %d pushes", tt.git.pushes, tt.wantPushes)
+			}
+		})
+	}
+}
+
+func TestWebURLFromRemote(t *testing.T) {
+	for _, remote := range []string{
+		"git@github.com:owner/repo.git",
+		"https://github.com/owner/repo.git",
+		"https://github.com/owner/repo",
+		"ssh://git@github.com/owner/repo.git",
+		"ssh://git@github.com:22/owner/repo.git",
+		"https://github.com:443/owner/repo/",
+	} {
+		got, err := webURLFromRemote(remote)
+		if err != nil || got != "https://github.com/owner/repo" {
+			t.Errorf("webURLFromRemote(%q) = %q, %v, want https://github.com/owner/repo", remote, got, err)
+		}
+	}
+}
+
+func TestDetectTicketNumber(t *testing.T) {
+	g := &GitAI{gitOps: &GitOperations{}}
+	setConfig(t, "TICKET_PATTERNS", "gh-(\\d+); [A-Z]{2,5}-\\d+\n(?i)task(\\d{1,6})")
+	for branch, want := range map[string]string{
+		"feature/gh-42-login":   "42",
+		"feature/ABC-7-login":   "ABC-7",
+		"feature/A-7-login":     "NO-TICKET",
+		"feature/TASK123-login": "123",
+		"feature/login":         "NO-TICKET",
+	} {
+		if got := g.detectTicketNumber(branch); got != want {
+			t.Errorf("detectTicketNumber(%q) = %q, want %q", branch, got, want)
+		}
+	}
+}
+
+func TestBuildCommitArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		separate bool
+		message  string
+		flags    []string
+		want     []string
+	}{
+		{"subject only", false, "✨ feat: add login", nil, []string{"commit", "-m", "✨ feat: add login"}},
+		{"single -m", false, "✨ feat: add login\n\nWith OAuth.", []string{"--amend"}, []string{"commit", "--amend", "-m", "✨ feat: add login\n\nWith OAuth."}},
+		{"separate body", true, "✨ feat: add login\n\nWith OAuth.\nAnd tests.", nil, []string{"commit", "-m", "✨ feat: add login", "-m", "With OAuth.\nAnd tests."}},
+		{"separate without body", true, "✨ feat: add login\n\n", []string{"-s"}, []string{"commit", "-s", "-m", "✨ feat: add login\n\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, "COMMIT_SEPARATE_BODY", tt.separate)
+			got := buildCommitArgs(tt.message, tt.flags)
+			if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") {
+				t.Errorf("buildCommitArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeProvider answers every request with the same reply and records the
+// models and inputs it was asked with.
+type fakeProvider struct {
+	reply  string
+	err    error
+	models []string
+	inputs []string
+}
+
+func (p *fakeProvider) Generate(_ context.Context, _, _, input string, opts GenerateOptions) (string, Usage, error) {
+	p.models = append(p.models, opts.Model)
+	p.inputs = append(p.inputs, input)
+	if p.err != nil {
+		return "", Usage{}, p.err
+	}
+	return p.reply, Usage{PromptTokens: 1, CompletionTokens: 1}, nil
+}
+
+func TestGenerateMessageModels(t *testing.T) {
+	tests := []struct {
+		draft, refine string
+		wantModels    []string
+	}{
+		{"", "", []string{"gpt-default"}},
+		{"small", "", []string{"small"}},
+		{"", "large", []string{"large"}},
+		{"small", "large", []string{"small", "large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.draft+"/"+tt.refine, func(t *testing.T) {
+			setConfig(t, "OPENAI_MODEL", "gpt-default")
+			setConfig(t, "DRAFT_MODEL", tt.draft)
+			setConfig(t, "REFINE_MODEL", tt.refine)
+			provider := &fakeProvider{reply: "✨ feat: add login"}
+			g := &GitAI{gitOps: &GitOperations{}, provider: provider}
+			if _, err := g.GenerateMessage(taskCommit, "system", "user", "INPUT DIFF"); err != nil {
+				t.Fatal(err)
+			}
+			for i, input := range provider.inputs {
+				if !strings.Contains(input, "INPUT DIFF") {
+					t.Errorf("request to %s does not contain the input: %q", provider.models[i], input)
+				}
+			}
+			if strings.Join(provider.models, ",") != strings.Join(tt.wantModels, ",") {
+				t.Errorf("models = %v, want %v", provider.models, tt.wantModels)
+			}
+		})
+	}
+}
+
+func TestReviewAIOutputNoEdit(t *testing.T) {
+	setConfig(t, "GAI_NO_EDIT", true)
+	g := &GitAI{gitOps: &GitOperations{}}
+	for content, wantOK := range map[string]bool{"✨ feat: add login": true, "": false, " \n\t": false} {
+		got, ok := g.reviewAIOutput(content)
+		if ok != wantOK || (ok && got != content) {
+			t.Errorf("reviewAIOutput(%q) = %q, %v, want ok %v", content, got, ok, wantOK)
+		}
+	}
+}
+
+func TestGenerateDiffBasedMessageNoEdit(t *testing.T) {
+	initRepo(t)
+	setConfig(t, "GAI_NO_EDIT", true)
+	if err := os.WriteFile("login.go", []byte("package login\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "login.go")
+	for reply, wantOK := range map[string]bool{"✨ feat: add login": true, "": false} {
+		g := &GitAI{gitOps: &GitOperations{}, provider: &fakeProvider{reply: reply}}
+		message, ok := g.generateDiffBasedMessage(true)
+		if ok != wantOK || message != reply {
+			t.Errorf("generateDiffBasedMessage with reply %q = %q, %v, want ok %v", reply, message, ok, wantOK)
+		}
+	}
+}
+
+func TestOllamaProvider(t *testing.T) {
+	var got ollamaRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/chat":
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Errorf("invalid request body: %v", err)
+			}
+			w.Write([]byte(`{"model":"llama3","message":{"role":"assistant","content":"✨ feat: add login"},"done":true,"done_reason":"stop","prompt_eval_count":42,"eval_count":7}`))
+		case "/api/tags":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	p := &ollamaProvider{host: srv.URL}
+
+	message, usage, err := p.Generate(context.Background(), "system", "user", "input", GenerateOptions{Model: "llama3", MaxTokens: 100, Temperature: 0.2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message != "✨ feat: add login" {
+		t.Errorf("message = %q", message)
+	}
+	if usage != (Usage{PromptTokens: 42, CompletionTokens: 7}) {
+		t.Errorf("usage = %+v, want 42 prompt and 7 completion tokens", usage)
+	}
+	if got.Model != "llama3" || got.Stream || len(got.Messages) != 3 || got.Messages[0].Role != "system" || got.Options["num_predict"] != float64(100) {
+		t.Errorf("unexpected request %+v", got)
+	}
+
+	if _, err := p.ListModels(context.Background()); err == nil {
+		t.Error("ListModels succeeded on a 500 response")
+	}
+}
+
+// fakeStream replays chunks and then fails with err, or ends when err is nil.
+type fakeStream struct {
+	chunks []openai.ChatCompletionStreamResponse
+	err    error
+}
+
+func (s *fakeStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if len(s.chunks) == 0 {
+		if s.err != nil {
+			return openai.ChatCompletionStreamResponse{}, s.err
+		}
+		return openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func deltaChunk(content string) openai.ChatCompletionStreamResponse {
+	return openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: content}}}}
+}
+
+func TestReadStream(t *testing.T) {
+	usage := openai.ChatCompletionStreamResponse{Usage: &openai.Usage{PromptTokens: 42, CompletionTokens: 7}}
+	tests := []struct {
+		name    string
+		stream  *fakeStream
+		want    string
+		wantErr bool
+	}{
+		{"complete", &fakeStream{chunks: []openai.ChatCompletionStreamResponse{deltaChunk("✨ feat"), deltaChunk(""), deltaChunk(": add login"), usage}}, "✨ feat: add login", false},
+		{"interrupted", &fakeStream{chunks: []openai.ChatCompletionStreamResponse{deltaChunk("✨ feat"), deltaChunk(": add")}, err: errors.New("connection reset")}, "✨ feat: add", true},
+		{"empty", &fakeStream{}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var record metricsRecord
+			var tokens []string
+			got, err := readStream(tt.stream, &record, func(text string) { tokens = append(tokens, text) })
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("readStream() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+			if strings.Join(tokens, "") != tt.want {
+				t.Errorf("onToken received %q, want %q", tokens, tt.want)
+			}
+			if tt.name == "complete" && (record.PromptTokens != 42 || record.CompletionTokens != 7) {
+				t.Errorf("record = %+v, want 42 prompt and 7 completion tokens", record)
+			}
+		})
+	}
+}
+
+func TestGenerateDiffBasedMessagePartialStream(t *testing.T) {
+	initRepo(t)
+	setConfig(t, "GAI_STREAM", true)
+	if err := os.WriteFile("login.go", []byte("package login\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "login.go")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"✨ feat: add\"}}]}\n\n"))
+		w.Write([]byte("data: {not json\n\n"))
+	}))
+	defer srv.Close()
+	cfg := openai.DefaultConfig("test")
+	cfg.BaseURL = srv.URL
+	g := &GitAI{gitOps: &GitOperations{}, provider: &openAIProvider{openai.NewClientWithConfig(cfg)}}
+
+	message, partial, err := g.streamToTerminal(taskCommit, "user", "diff")
+	if err != nil || !partial || !strings.HasPrefix(message, "✨ feat: add\n\n# NOTE: The AI stream was interrupted") {
+		t.Errorf("streamToTerminal() = %q, %v, %v, want the partial message", message, partial, err)
+	}
+
+	setConfig(t, "GAI_NO_EDIT", true)
+	if message, ok := g.generateDiffBasedMessage(true); ok {
+		t.Errorf("generateDiffBasedMessage accepted the partial message %q without the editor", message)
+	}
+}
+
+func TestPickCandidate(t *testing.T) {
+	candidates := []string{"✨ feat: add login", "✨ feat(auth): add login", "✨ feat: support logging in"}
+	tests := []struct {
+		name   string
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{"first", "1\n", candidates[0], true},
+		{"last", "3\n", candidates[2], true},
+		{"surrounding spaces", "  2 \n", candidates[1], true},
+		{"no trailing newline", "2", candidates[1], true},
+		{"cancel", "0\n", "", false},
+		{"out of range", "4\n", "", false},
+		{"negative", "-1\n", "", false},
+		{"retry then valid", "4\nabc\n\n2\n", candidates[1], true},
+		{"retry then cancel", "x\n0\n", "", false},
+		{"eof", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := pickCandidate(candidates, strings.NewReader(tt.input))
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("pickCandidate(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseCandidateChoice(t *testing.T) {
+	tests := []struct {
+		answer  string
+		want    int
+		wantErr bool
+	}{
+		{"1", 1, false},
+		{"3\n", 3, false},
+		{"0", 0, false},
+		{"4", 0, true},
+		{"-1", 0, true},
+		{"two", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCandidateChoice(tt.answer, 3)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseCandidateChoice(%q, 3) = %d, %v, want %d, error %v", tt.answer, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestGenerateDiffBasedMessageOfflineNoEdit(t *testing.T) {
+	initRepo(t)
+	setConfig(t, "GAI_NO_EDIT", true)
+	setConfig(t, "OFFLINE_FALLBACK", true)
+	if err := os.WriteFile("login.go", []byte("package login\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "login.go")
+	g := &GitAI{gitOps: &GitOperations{}, provider: &fakeProvider{err: errors.New("connection refused")}}
+	if message, ok := g.generateDiffBasedMessage(true); ok {
+		t.Errorf("generateDiffBasedMessage accepted the offline message %q without the editor", message)
+	}
+}
+
+func TestRewordBranchWithoutBase(t *testing.T) {
+	initRepo(t)
+	git(t, "commit", "--quiet", "--allow-empty", "-m", "initial")
+	git(t, "checkout", "--quiet", "-b", "feature/login")
+	git(t, "commit", "--quiet", "--allow-empty", "-m", "wip")
+	head := git(t, "rev-parse", "HEAD")
+	g := &GitAI{gitOps: &GitOperations{}, provider: &fakeProvider{reply: "✨ feat: add login"}}
+	if err := g.RewordBranch(); err == nil {
+		t.Error("RewordBranch succeeded without origin/<base>")
+	}
+	if got := git(t, "rev-parse", "HEAD"); got != head {
+		t.Errorf("RewordBranch rewrote HEAD from %s to %s", head, got)
+	}
+}
+
+func TestRegenerateConflictMarkers(t *testing.T) {
+	initRepo(t)
+	if err := os.WriteFile("login.go", []byte("package login\n<<<<<<< HEAD\nvar a = 1\n=======\nvar a = 2\n>>>>>>> main\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "login.go")
+	provider := &fakeProvider{reply: "✨ feat: add login"}
+	g := &GitAI{gitOps: &GitOperations{}, provider: provider}
+	if err := g.Regenerate(nil, false); err == nil {
+		t.Error("Regenerate committed staged conflict markers")
+	}
+	if len(provider.models) != 0 {
+		t.Error("Regenerate asked the AI for a message despite the conflict markers")
+	}
+	if (&GitOperations{}).HasCommits() {
+		t.Error("Regenerate created a commit")
+	}
+}
+
+func TestPrintShipPlanInput(t *testing.T) {
+	initRepo(t)
+	setConfig(t, "EXCLUDE_TESTS", true)
+	for name, content := range map[string]string{"login.go": "package login\n", "login_test.go": "package login_test\n"} {
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider := &fakeProvider{reply: "🎉 chore: add login"}
+	g := &GitAI{gitOps: &GitOperations{}, pushGit: &fakePushGit{}, forge: fakeForge{}, provider: provider}
+	if err := g.PrintShipPlan(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.inputs) != 1 {
+		t.Fatalf("PrintShipPlan made %d AI requests, want 1", len(provider.inputs))
+	}
+	input := provider.inputs[0]
+	if !strings.Contains(input, "package login\n") || strings.Contains(input, "package login_test") {
+		t.Errorf("input does not contain exactly the staged non-test diff: %q", input)
+	}
+	if !strings.Contains(input, "first commit of the repository") {
+		t.Errorf("input is missing the commit context: %q", input)
+	}
+	if staged := git(t, "diff", "--cached", "--name-only"); staged != "" {
+		t.Errorf("PrintShipPlan staged %q", staged)
+	}
+}
+
+func TestAITimeout(t *testing.T) {
+	for value, want := range map[any]time.Duration{
+		"90":      90 * time.Second,
+		90:        90 * time.Second,
+		"1.5":     1500 * time.Millisecond,
+		"2m":      2 * time.Minute,
+		"0":       0,
+		time.Hour: time.Hour,
+		"":        0,
+		" 30 ":    30 * time.Second,
+		"250ms":   250 * time.Millisecond,
+	} {
+		setConfig(t, "GAI_TIMEOUT", value)
+		if got := aiTimeout(); got != want {
+			t.Errorf("aiTimeout() with GAI_TIMEOUT=%v = %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestWithSigning(t *testing.T) {
+	tests := []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "-S"},
+		{[]string{"--no-verify"}, "--no-verify -S"},
+		{[]string{"-S"}, "-S"},
+		{[]string{"-SABCD1234"}, "-SABCD1234"},
+		{[]string{"--gpg-sign"}, "--gpg-sign"},
+		{[]string{"--gpg-sign=ABCD1234"}, "--gpg-sign=ABCD1234"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(withSigning(tt.flags), " "); got != tt.want {
+			t.Errorf("withSigning(%q) = %q, want %q", tt.flags, got, tt.want)
+		}
+	}
+}
+
+func TestCommitWithMessageUnverifiedSignature(t *testing.T) {
+	dir := initRepo(t)
+	// A signing program that signs anything, so git commit -S succeeds and
+	// git verify-commit fails
+	gpg := dir + "/fake-gpg"
+	script := "#!/bin/sh\ncat >/dev/null\nprintf '\\n[GNUPG:] SIG_CREATED \\n' >&2\nprintf -- '-----BEGIN PGP SIGNATURE-----\\n\\nfake\\n-----END PGP SIGNATURE-----\\n'\n"
+	if err := os.WriteFile(gpg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "config", "gpg.program", gpg)
+	git(t, "config", "user.signingkey", "fake")
+	setConfig(t, "COMMIT_SIGN", true)
+	g := &GitAI{gitOps: &GitOperations{}}
+	if err := g.commitWithMessage("✨ feat: add login", []string{"--allow-empty"}); err != nil {
+		t.Errorf("commitWithMessage failed after the commit was created: %v", err)
+	}
+	if got := git(t, "log", "-1", "--pretty=%s"); got != "✨ feat: add login" {
+		t.Errorf("HEAD subject = %q, want the new commit", got)
+	}
+}
+
+func TestGenerateDiffBasedMessageOfflineTrailer(t *testing.T) {
+	initRepo(t)
+	t.Setenv("EDITOR", "true")
+	setConfig(t, "OFFLINE_FALLBACK", true)
+	if err := os.WriteFile("login.go", []byte("package login\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "add", "login.go")
+	g := &GitAI{gitOps: &GitOperations{}, provider: &fakeProvider{err: errors.New("connection refused")}}
+	message, ok := g.generateDiffBasedMessage(true)
+	if !ok {
+		t.Fatal("generateDiffBasedMessage canceled the offline message")
+	}
+	if !strings.HasPrefix(message, "✨ feat: add 1 file (+1/-0)") || !strings.HasSuffix(message, "\n\n"+offlineTrailer) || strings.Contains(message, "# NOTE") {
+		t.Errorf("offline message = %q, want the stat subject and the %q trailer", message, offlineTrailer)
+	}
+}